@@ -0,0 +1,217 @@
+// Command ldhcpd-admin is a CLI client for the Admin gRPC surface exposed by
+// ldhcpd, for listing, releasing, purging, and watching leases from the
+// command line.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/erikh/ldhcpd/grpc/adminpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+
+	cmd := os.Args[1]
+	args := os.Args[2:]
+
+	var err error
+	switch cmd {
+	case "list":
+		err = runList(args)
+	case "release":
+		err = runRelease(args)
+	case "purge":
+		err = runPurge(args)
+	case "set-persistent":
+		err = runSetPersistent(args)
+	case "watch":
+		err = runWatch(args)
+	default:
+		usage()
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: ldhcpd-admin <list|release|purge|set-persistent|watch> [flags]")
+}
+
+func dial(addr string) (adminpb.AdminClient, func(), error) {
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not dial %s: %w", addr, err)
+	}
+
+	return adminpb.NewAdminClient(conn), func() { conn.Close() }, nil
+}
+
+func runList(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:9090", "admin gRPC address")
+	macPrefix := fs.String("mac-prefix", "", "filter by MAC prefix")
+	from := fs.String("ip-from", "", "filter by IP range start")
+	to := fs.String("ip-to", "", "filter by IP range end")
+	persistentOnly := fs.Bool("persistent-only", false, "only show persistent leases")
+	expiredOnly := fs.Bool("expired-only", false, "only show expired leases")
+	includeV6 := fs.Bool("include-v6", false, "also show DHCPv6 leases, if the server is dual-stack")
+	pageSize := fs.Int("page-size", 0, "leases fetched per RPC (0 uses the server default)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	client, closer, err := dial(*addr)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	var pageToken string
+	for {
+		resp, err := client.ListLeases(context.Background(), &adminpb.ListLeasesRequest{
+			MacPrefix:      *macPrefix,
+			IpRangeFrom:    *from,
+			IpRangeTo:      *to,
+			PersistentOnly: *persistentOnly,
+			ExpiredOnly:    *expiredOnly,
+			IncludeV6:      *includeV6,
+			PageSize:       int32(*pageSize),
+			PageToken:      pageToken,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, l := range resp.Leases {
+			if l.Family == adminpb.Family_V6 {
+				fmt.Printf("v6\t%s\t%s\texpires=%s\n", l.Duid, l.Ip, l.LeaseEnd.AsTime().Format(time.RFC3339))
+				continue
+			}
+
+			fmt.Printf("v4\t%s\t%s\t%s\tpersistent=%v\texpires=%s\n", l.Mac, l.Ip, l.Hostname, l.Persistent, l.LeaseEnd.AsTime().Format(time.RFC3339))
+		}
+
+		if resp.NextPageToken == "" {
+			return nil
+		}
+		pageToken = resp.NextPageToken
+	}
+}
+
+func runRelease(args []string) error {
+	fs := flag.NewFlagSet("release", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:9090", "admin gRPC address")
+	mac := fs.String("mac", "", "MAC address to release")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *mac == "" {
+		return fmt.Errorf("-mac is required")
+	}
+
+	client, closer, err := dial(*addr)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	_, err = client.ReleaseLease(context.Background(), &adminpb.ReleaseLeaseRequest{Mac: *mac})
+	return err
+}
+
+func runPurge(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:9090", "admin gRPC address")
+	includeGrace := fs.Bool("include-grace", false, "also purge leases still within their grace period")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	client, closer, err := dial(*addr)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	resp, err := client.PurgeExpired(context.Background(), &adminpb.PurgeExpiredRequest{IncludeGrace: *includeGrace})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("purged %d lease(s)\n", resp.Purged)
+	return nil
+}
+
+func runSetPersistent(args []string) error {
+	fs := flag.NewFlagSet("set-persistent", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:9090", "admin gRPC address")
+	mac := fs.String("mac", "", "MAC address to update")
+	persistent := fs.Bool("persistent", true, "mark the lease persistent (false to demote)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *mac == "" {
+		return fmt.Errorf("-mac is required")
+	}
+
+	client, closer, err := dial(*addr)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	_, err = client.SetPersistent(context.Background(), &adminpb.SetPersistentRequest{Mac: *mac, Persistent: *persistent})
+	return err
+}
+
+func runWatch(args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:9090", "admin gRPC address")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	client, closer, err := dial(*addr)
+	if err != nil {
+		return err
+	}
+	defer closer()
+
+	stream, err := client.WatchLeases(context.Background(), &adminpb.WatchLeasesRequest{})
+	if err != nil {
+		return err
+	}
+
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if event.Lease != nil {
+			fmt.Printf("%s\t%s\t%s\t%s\n", event.At.AsTime().Format(time.RFC3339), event.Type, event.Lease.Mac, event.Lease.Ip)
+		} else {
+			fmt.Printf("%s\t%s\tcount=%d\n", event.At.AsTime().Format(time.RFC3339), event.Type, event.PurgedCount)
+		}
+	}
+}
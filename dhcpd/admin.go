@@ -0,0 +1,256 @@
+package dhcpd
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/erikh/ldhcpd/db"
+	"github.com/krolaw/dhcp4"
+	"github.com/pkg/errors"
+)
+
+// defaultListLeasesPageSize caps a single ListLeases page when the caller
+// doesn't specify one, so a client can't accidentally pull an entire
+// /16-sized pool in one RPC.
+const defaultListLeasesPageSize = 1000
+
+// LeaseFilter narrows the results of ListLeases. A zero-value LeaseFilter
+// matches every lease.
+type LeaseFilter struct {
+	MACPrefix      string
+	IPFrom, IPTo   net.IP
+	PersistentOnly bool
+	ExpiredOnly    bool
+	// RangeTag, if set, restricts results to leases whose IP falls within
+	// the DynamicRanges entry with a matching Tag.
+	RangeTag string
+
+	// PageSize caps how many leases ListLeases returns; <= 0 means
+	// defaultListLeasesPageSize.
+	PageSize int
+	// PageToken resumes after the lease returned as the previous page's
+	// nextPageToken. Empty starts from the beginning.
+	PageToken string
+}
+
+func (f LeaseFilter) matches(l db.Lease) bool {
+	if f.MACPrefix != "" && !strings.HasPrefix(strings.ToLower(l.Mac.String()), strings.ToLower(f.MACPrefix)) {
+		return false
+	}
+
+	if f.IPFrom != nil && f.IPTo != nil {
+		ip := l.IP().To4()
+		if ip == nil || !dhcp4.IPInRange(f.IPFrom, f.IPTo, ip) {
+			return false
+		}
+	}
+
+	if f.PersistentOnly && !l.Persistent {
+		return false
+	}
+
+	if f.ExpiredOnly && !l.LeaseGraceEnd.Before(time.Now()) {
+		return false
+	}
+
+	return true
+}
+
+// matchesRangeTag reports whether l falls within the DynamicRanges entry
+// tagged rangeTag. An empty rangeTag always matches; a lease outside every
+// configured range (e.g. a reservation installed from outside the dynamic
+// pool) never matches a non-empty rangeTag.
+func (a *Allocator) matchesRangeTag(l db.Lease, rangeTag string) bool {
+	if rangeTag == "" {
+		return true
+	}
+
+	idx, _, ok := a.locate(l.IP())
+	return ok && a.ranges[idx].spec.Tag == rangeTag
+}
+
+// ListLeases returns a page of leases matching filter, sorted by IP for
+// stable paging, along with the token to pass as PageToken to fetch the
+// next page (empty once exhausted). This backs the ListLeases RPC on the
+// admin gRPC surface.
+func (a *Allocator) ListLeases(filter LeaseFilter) ([]db.Lease, string, error) {
+	leases, err := a.db.Leases()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "could not list leases")
+	}
+
+	matched := make([]db.Lease, 0, len(leases))
+	for _, l := range leases {
+		if filter.matches(l) && a.matchesRangeTag(l, filter.RangeTag) {
+			matched = append(matched, l)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		return dhcp4.IPLess(matched[i].IP(), matched[j].IP())
+	})
+
+	start := 0
+	if filter.PageToken != "" {
+		cursor := net.ParseIP(filter.PageToken).To4()
+		if cursor == nil {
+			return nil, "", errors.Errorf("invalid page token %q", filter.PageToken)
+		}
+
+		start = sort.Search(len(matched), func(i int) bool {
+			return dhcp4.IPLess(cursor, matched[i].IP())
+		})
+	}
+
+	pageSize := filter.PageSize
+	if pageSize <= 0 {
+		pageSize = defaultListLeasesPageSize
+	}
+
+	end := start + pageSize
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	page := matched[start:end]
+
+	var nextToken string
+	if end < len(matched) {
+		nextToken = page[len(page)-1].IP().String()
+	}
+
+	return page, nextToken, nil
+}
+
+// ReleaseLease deletes mac's lease immediately, clearing its bitset bit so
+// the address is reusable right away. This backs the ReleaseLease RPC.
+func (a *Allocator) ReleaseLease(mac net.HardwareAddr) error {
+	l, err := a.db.GetLease(mac)
+	if err != nil {
+		return errors.Wrapf(err, "no lease on file for mac [%v]", mac)
+	}
+
+	if err := a.db.DeleteLease(mac); err != nil {
+		return errors.Wrapf(err, "could not delete lease for mac [%v]", mac)
+	}
+
+	if idx, offset, ok := a.locate(l.IP()); ok {
+		sub := a.ranges[idx]
+		sub.bitsetMutex.Lock()
+		sub.used.clear(offset)
+		sub.persistent.clear(offset)
+		sub.bitsetMutex.Unlock()
+	}
+
+	a.publish(LeaseEvent{Type: EventLeaseReleased, MAC: mac, IP: l.IP(), Hostname: l.Hostname, At: time.Now()})
+
+	return nil
+}
+
+// PurgeExpired wraps db.PurgeLeases, refreshes the allocator's bitsets to
+// match, and reports how many leases were removed. This backs the
+// PurgeExpired RPC.
+func (a *Allocator) PurgeExpired(includeGrace bool) (int, error) {
+	count, err := a.db.PurgeLeases(includeGrace)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not purge expired leases")
+	}
+
+	if err := a.reload(); err != nil {
+		return count, errors.Wrap(err, "purged leases but could not refresh allocator state")
+	}
+
+	if count > 0 {
+		a.publish(LeaseEvent{Type: EventLeasePurged, Count: count, At: time.Now()})
+	}
+
+	return count, nil
+}
+
+// SetPersistent promotes or demotes mac's existing lease. This backs the
+// SetPersistent RPC.
+func (a *Allocator) SetPersistent(mac net.HardwareAddr, persistent bool) error {
+	l, err := a.db.SetPersistent(mac, persistent)
+	if err != nil {
+		return errors.Wrapf(err, "could not update persistence for mac [%v]", mac)
+	}
+
+	if idx, offset, ok := a.locate(l.IP()); ok {
+		sub := a.ranges[idx]
+		sub.bitsetMutex.Lock()
+		if persistent {
+			sub.persistent.set(offset)
+		} else {
+			sub.persistent.clear(offset)
+		}
+		sub.bitsetMutex.Unlock()
+	}
+
+	return nil
+}
+
+// EventType enumerates the kinds of change a LeaseEvent can describe.
+type EventType int
+
+const (
+	// EventLeaseAdded fires when a new lease (dynamic, preferred, or
+	// reservation-backed) is installed.
+	EventLeaseAdded EventType = iota
+	// EventLeaseRenewed fires when an existing lease's expiry is extended.
+	EventLeaseRenewed
+	// EventLeaseReleased fires when ReleaseLease removes a lease.
+	EventLeaseReleased
+	// EventLeasePurged fires once per PurgeExpired call that removed at
+	// least one lease; Count holds how many.
+	EventLeasePurged
+)
+
+// LeaseEvent describes a single change to the lease table, as streamed by
+// WatchLeases.
+type LeaseEvent struct {
+	Type     EventType
+	MAC      net.HardwareAddr
+	IP       net.IP
+	Hostname string
+	// Count is only meaningful for EventLeasePurged, where no single
+	// MAC/IP applies.
+	Count int
+	At    time.Time
+}
+
+// Watch subscribes to lease change events. Call the returned cancel func to
+// unsubscribe and release the channel; failing to do so leaks it. This
+// backs the streaming WatchLeases RPC.
+func (a *Allocator) Watch() (<-chan LeaseEvent, func()) {
+	ch := make(chan LeaseEvent, 16)
+
+	a.watchersMutex.Lock()
+	a.watchers[ch] = struct{}{}
+	a.watchersMutex.Unlock()
+
+	cancel := func() {
+		a.watchersMutex.Lock()
+		delete(a.watchers, ch)
+		a.watchersMutex.Unlock()
+		close(ch)
+	}
+
+	return ch, cancel
+}
+
+// publish fans event out to every current watcher. A subscriber that isn't
+// keeping up is skipped for this event rather than blocking the allocation
+// path that produced it.
+func (a *Allocator) publish(event LeaseEvent) {
+	a.watchersMutex.RLock()
+	defer a.watchersMutex.RUnlock()
+
+	for ch := range a.watchers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
@@ -1,12 +1,13 @@
 package dhcpd
 
 import (
+	"encoding/binary"
+	"hash/fnv"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/erikh/ldhcpd/db"
-	"github.com/krolaw/dhcp4"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
@@ -14,92 +15,408 @@ import (
 // ErrRangeExhausted is returned when the IP range is exhausted
 var ErrRangeExhausted = errors.New("IP range exhausted")
 
-// Allocator allocates IP addresses from a range
+// subAllocator tracks the offset-addressed state (used/persistent bitsets,
+// conflict-probe blacklist) for a single RangeSpec. Allocator dispatches
+// across a slice of these so that allocations against one range never
+// contend with another's mutex.
+type subAllocator struct {
+	spec      RangeSpec
+	rangeFrom net.IP
+	rangeSize int
+	lease     Lease
+
+	used        *bitset
+	persistent  *bitset
+	bitsetMutex sync.Mutex
+
+	// blacklist holds offsets that recently failed a conflict probe,
+	// mapped to when they become eligible again.
+	blacklist map[int]time.Time
+}
+
+func newSubAllocator(spec RangeSpec, defaultLease Lease) *subAllocator {
+	first, last := spec.Dimensions()
+
+	lease := defaultLease
+	if spec.Lease != nil {
+		lease = *spec.Lease
+	}
+
+	return &subAllocator{
+		spec:      spec,
+		rangeFrom: first,
+		rangeSize: ipOffset(first, last) + 1,
+		lease:     lease,
+		blacklist: map[int]time.Time{},
+	}
+}
+
+// nextCandidateLocked scans forward from start, wrapping around once, for
+// an offset that is neither used, persistent, nor still blacklisted from a
+// failed probe. Expired blacklist entries are pruned as they're found.
+// Callers must hold s.bitsetMutex.
+func (s *subAllocator) nextCandidateLocked(start int) (int, bool) {
+	now := time.Now()
+
+	for i := 0; i < s.rangeSize; i++ {
+		offset := (start + i) % s.rangeSize
+
+		if s.used.isSet(offset) || s.persistent.isSet(offset) {
+			continue
+		}
+
+		if until, blacklisted := s.blacklist[offset]; blacklisted {
+			if until.After(now) {
+				continue
+			}
+			delete(s.blacklist, offset)
+		}
+
+		return offset, true
+	}
+
+	return 0, false
+}
+
+// Allocator dispatches IP allocation across one or more dynamic ranges
 type Allocator struct {
 	config Config
 	db     *db.DB
 
-	lastIP      net.IP
-	lastIPMutex sync.Mutex
+	ranges []*subAllocator
+
+	prober       Prober
+	reservations *reservations
+
+	watchers      map[chan LeaseEvent]struct{}
+	watchersMutex sync.RWMutex
 }
 
 // NewAllocator creates a new allocator
 func NewAllocator(db *db.DB, c Config, initial net.IP) (*Allocator, error) {
-	if initial == nil {
-		initial = net.ParseIP(c.DynamicRange.From)
+	a := &Allocator{
+		config:       c,
+		db:           db,
+		prober:       newProber(c.ConflictProbe),
+		reservations: newReservations(c.Reservations),
+		watchers:     map[chan LeaseEvent]struct{}{},
+	}
+
+	for _, spec := range c.DynamicRanges {
+		a.ranges = append(a.ranges, newSubAllocator(spec, c.Lease))
+	}
+
+	if err := a.reload(); err != nil {
+		return nil, errors.Wrap(err, "could not load lease state into allocator")
 	}
 
-	return &Allocator{
-		config: c,
-		db:     db,
-		lastIP: dhcp4.IPAdd(initial, -1),
-	}, nil
+	return a, nil
+}
+
+// reload rebuilds every range's bitsets from the current contents of the
+// lease table. It is used at startup and after a purge so the allocator's
+// in-memory view never drifts from the database.
+func (a *Allocator) reload() error {
+	leases, err := a.db.Leases()
+	if err != nil {
+		return err
+	}
+
+	used := make([]*bitset, len(a.ranges))
+	persistent := make([]*bitset, len(a.ranges))
+	for i, sub := range a.ranges {
+		used[i] = newBitset(sub.rangeSize)
+		persistent[i] = newBitset(sub.rangeSize)
+	}
+
+	now := time.Now()
+	for _, l := range leases {
+		if !l.Persistent && l.LeaseGraceEnd.Before(now) {
+			continue
+		}
+
+		idx, offset, ok := a.locate(l.IP())
+		if !ok {
+			continue
+		}
+
+		used[idx].set(offset)
+		if l.Persistent {
+			persistent[idx].set(offset)
+		}
+	}
+
+	// a reservation pins its offset even before its lease is first
+	// installed, so the dynamic path never hands it to another MAC.
+	for _, r := range a.reservations.list() {
+		ip := net.ParseIP(r.IP).To4()
+		if idx, offset, ok := a.locate(ip); ok {
+			persistent[idx].set(offset)
+		}
+	}
+
+	for i, sub := range a.ranges {
+		sub.bitsetMutex.Lock()
+		sub.used = used[i]
+		sub.persistent = persistent[i]
+		sub.bitsetMutex.Unlock()
+	}
+
+	return nil
+}
+
+// locate returns the index of, and offset within, the range containing ip.
+func (a *Allocator) locate(ip net.IP) (int, int, bool) {
+	for i, sub := range a.ranges {
+		offset := ipOffset(sub.rangeFrom, ip)
+		if offset >= 0 && offset < sub.rangeSize {
+			return i, offset, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// ipOffset returns the distance of ip from from, as an offset into a range
+// starting at from. Both IPs are assumed to be IPv4.
+func ipOffset(from, ip net.IP) int {
+	return int(binary.BigEndian.Uint32(ip.To4())) - int(binary.BigEndian.Uint32(from.To4()))
+}
+
+// offsetIP returns the IP at offset from from.
+func offsetIP(from net.IP, offset int) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(from.To4())+uint32(offset))
+	return ip
+}
+
+// macOffset hashes mac into an offset within [0, rangeSize), used as the
+// starting point for a scan so a given MAC tends to land on the same
+// address across allocations of an empty pool.
+func macOffset(mac net.HardwareAddr, rangeSize int) int {
+	h := fnv.New32a()
+	h.Write(mac)
+	return int(h.Sum32() % uint32(rangeSize))
+}
+
+// Stats returns the combined size of all dynamic ranges, how many of their
+// offsets are currently occupied, and how many are pinned as persistent.
+// The persistent count includes reservations whose lease has not been
+// installed yet, which are not counted as used.
+func (a *Allocator) Stats() (total, used, persistentCount int) {
+	for _, sub := range a.ranges {
+		sub.bitsetMutex.Lock()
+		total += sub.rangeSize
+		used += sub.used.count()
+		persistentCount += sub.persistent.count()
+		sub.bitsetMutex.Unlock()
+	}
+
+	return total, used, persistentCount
 }
 
 // Allocate or Retrieve an IP address for a mac. renew states that if there is
 // already an IP present in the leases table for this mac, to renew the lease
-// if necessary.
-func (a *Allocator) Allocate(mac net.HardwareAddr, renew bool, preferred net.IP) (net.IP, error) {
+// if necessary. hostname is the client-supplied hostname, if any, and is
+// stored alongside the lease; it is ignored for a MAC holding a reservation,
+// whose configured hostname always wins.
+func (a *Allocator) Allocate(mac net.HardwareAddr, renew bool, preferred net.IP, hostname string) (net.IP, error) {
 	now := time.Now()
 	// FIXME returning lease end here may help with some distributed race conditions we're seeing
 	l, err := a.db.GetLease(mac)
 	if err == nil {
 		if (renew && (l.LeaseEnd.Before(now) || l.LeaseGraceEnd.Before(now))) || l.Persistent {
-			leaseEnd := now.Add(a.config.Lease.Duration)
-			l, err = a.db.RenewLease(mac, leaseEnd, leaseEnd.Add(a.config.Lease.GracePeriod))
+			duration := a.config.Lease.Duration
+			gracePeriod := a.config.Lease.GracePeriod
+			if r, ok := a.reservations.byMACAddr(mac); ok && r.LeaseDuration != 0 {
+				// a reservation's override must keep applying on every
+				// renewal, not just the first time its lease is installed.
+				duration = r.LeaseDuration
+				gracePeriod = 0
+			}
+
+			leaseEnd := now.Add(duration)
+			l, err = a.db.RenewLease(mac, leaseEnd, leaseEnd.Add(gracePeriod))
 			if err != nil {
-				return nil, errors.Wrapf(err, "could not renew lease for mac [%v] ip [%v]", mac, a.lastIP)
+				return nil, errors.Wrapf(err, "could not renew lease for mac [%v]", mac)
 			}
+
+			a.publish(LeaseEvent{Type: EventLeaseRenewed, MAC: mac, IP: l.IP(), Hostname: l.Hostname, At: now})
 		}
 
 		return l.IP(), nil
 	}
 
-	first, last := a.config.DynamicRange.Dimensions()
+	if r, ok := a.reservations.byMACAddr(mac); ok {
+		return a.allocateReservation(mac, r, now)
+	}
 
-	// calculate these ahead of time to save a few cycles
-	leaseEnd := now.Add(a.config.Lease.Duration)
-	gracePeriodEnd := leaseEnd.Add(a.config.Lease.GracePeriod)
+	if preferred != nil {
+		if ip, ok := a.tryPreferred(mac, hostname, preferred, now); ok {
+			return ip, nil
+		}
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		for _, sub := range a.ranges {
+			if !sub.spec.ClientFilter.Matches(mac, hostname) {
+				continue
+			}
 
-	if preferred != nil && dhcp4.IPInRange(first, last, preferred) {
-		logrus.Infof("Preferred IP (%v) supplied; will attempt leasing that for [%v]", preferred, mac)
-		if err := a.db.SetLease(mac, preferred, true, false, leaseEnd, gracePeriodEnd); err != nil {
-			logrus.Warnf("[%v] Getting a lease for preferred IP (%v) was rejected due to an error: %v", mac, preferred, err)
-		} else {
-			return preferred, nil
+			ip, err := a.tryAllocate(sub, mac, hostname, now)
+			if err == nil {
+				return ip, nil
+			}
+
+			if err != ErrRangeExhausted {
+				return nil, err
+			}
+		}
+
+		// every matching range looked full; purge anything sitting in its
+		// grace period and re-derive our view of the world from the
+		// database before giving up.
+		if _, perr := a.db.PurgeLeases(true); perr != nil {
+			return nil, errors.Wrap(perr, "trying to clean up lease table")
+		}
+
+		if err := a.reload(); err != nil {
+			return nil, errors.Wrap(err, "trying to refresh allocator state after purge")
 		}
 	}
 
-	a.lastIPMutex.Lock()
-	defer a.lastIPMutex.Unlock()
+	return nil, ErrRangeExhausted
+}
 
-	var foundFirst, foundFirstClearedGrace bool
-	for {
-		ip := dhcp4.IPAdd(a.lastIP, 1)
+// tryPreferred attempts to hand out preferred as-is. It only applies if
+// preferred falls within one of the configured ranges, that range's filter
+// matches the request, and the address isn't reserved for a different MAC
+// or rejected by a conflict probe.
+func (a *Allocator) tryPreferred(mac net.HardwareAddr, hostname string, preferred net.IP, now time.Time) (net.IP, bool) {
+	idx, offset, ok := a.locate(preferred)
+	if !ok {
+		return nil, false
+	}
+	sub := a.ranges[idx]
 
-		if !dhcp4.IPInRange(first, last, ip) {
-			if foundFirst {
-				if foundFirstClearedGrace {
-					return nil, ErrRangeExhausted
-				}
+	if !sub.spec.ClientFilter.Matches(mac, hostname) {
+		return nil, false
+	}
 
-				_, err := a.db.PurgeLeases(true)
-				if err != nil {
-					return nil, errors.Wrap(err, "trying to clean up lease table")
-				}
+	if res, ok := a.reservations.byIPAddr(preferred); ok && res.MAC != mac.String() {
+		logrus.Warnf("[%v] Preferred IP (%v) is reserved for %v; falling back to dynamic selection", mac, preferred, res.MAC)
+		return nil, false
+	}
 
-				foundFirstClearedGrace = true
-			}
-			a.lastIP = first
-			foundFirst = true
-		} else {
-			a.lastIP = ip
+	conflict, perr := a.probe(preferred)
+	if perr != nil {
+		logrus.Warnf("[%v] Conflict probe for preferred IP (%v) failed: %v", mac, preferred, perr)
+	}
+
+	if conflict {
+		logrus.Warnf("[%v] Preferred IP (%v) answered a conflict probe; falling back to dynamic selection", mac, preferred)
+		return nil, false
+	}
+
+	logrus.Infof("Preferred IP (%v) supplied; will attempt leasing that for [%v]", preferred, mac)
+
+	leaseEnd := now.Add(sub.lease.Duration)
+	gracePeriodEnd := leaseEnd.Add(sub.lease.GracePeriod)
+
+	if err := a.db.SetLease(mac, preferred, true, false, hostname, leaseEnd, gracePeriodEnd); err != nil {
+		logrus.Warnf("[%v] Getting a lease for preferred IP (%v) was rejected due to an error: %v", mac, preferred, err)
+		return nil, false
+	}
+
+	sub.bitsetMutex.Lock()
+	sub.used.set(offset)
+	sub.bitsetMutex.Unlock()
+
+	a.publish(LeaseEvent{Type: EventLeaseAdded, MAC: mac, IP: preferred, Hostname: hostname, At: now})
+
+	return preferred, true
+}
+
+// tryAllocate finds a free, non-blacklisted offset within sub, reserves it,
+// probes it for an on-wire conflict if configured to do so, and commits it
+// to the database. A probe hit blacklists the offset for a TTL and moves on
+// to the next candidate within the same range rather than failing the
+// whole allocation.
+func (a *Allocator) tryAllocate(sub *subAllocator, mac net.HardwareAddr, hostname string, now time.Time) (net.IP, error) {
+	leaseEnd := now.Add(sub.lease.Duration)
+	gracePeriodEnd := leaseEnd.Add(sub.lease.GracePeriod)
+	start := macOffset(mac, sub.rangeSize)
+
+	for tried := 0; tried < sub.rangeSize; tried++ {
+		sub.bitsetMutex.Lock()
+		offset, ok := sub.nextCandidateLocked(start)
+		if !ok {
+			sub.bitsetMutex.Unlock()
+			return nil, ErrRangeExhausted
+		}
+		sub.used.set(offset)
+		sub.bitsetMutex.Unlock()
+
+		ip := offsetIP(sub.rangeFrom, offset)
+
+		// probing happens outside bitsetMutex so a slow ping can't stall
+		// other allocations; the offset is already tentatively reserved
+		// above so nobody else will race us for it.
+		conflict, err := a.probe(ip)
+		if err != nil {
+			logrus.Warnf("[%v] Conflict probe for %v failed: %v", mac, ip, err)
 		}
 
-		if err := a.db.SetLease(mac, a.lastIP, true, false, leaseEnd, gracePeriodEnd); err != nil {
+		if conflict {
+			logrus.Warnf("[%v] Conflict probe detected an existing host at %v; blacklisting and trying the next address", mac, ip)
+			sub.bitsetMutex.Lock()
+			sub.used.clear(offset)
+			sub.blacklist[offset] = time.Now().Add(a.config.ConflictProbe.BlacklistTTL)
+			sub.bitsetMutex.Unlock()
+			start = offset + 1
 			continue
 		}
 
-		return a.lastIP, nil
+		if err := a.db.SetLease(mac, ip, true, false, hostname, leaseEnd, gracePeriodEnd); err != nil {
+			sub.bitsetMutex.Lock()
+			sub.used.clear(offset)
+			sub.bitsetMutex.Unlock()
+			return nil, errors.Wrapf(err, "could not set lease for mac [%v] ip [%v]", mac, ip)
+		}
+
+		a.publish(LeaseEvent{Type: EventLeaseAdded, MAC: mac, IP: ip, Hostname: hostname, At: now})
+
+		return ip, nil
+	}
+
+	return nil, ErrRangeExhausted
+}
+
+// probe runs the configured conflict probe against ip, if any. It reports
+// true if something on the wire already appears to be using the address.
+func (a *Allocator) probe(ip net.IP) (bool, error) {
+	if a.prober == nil {
+		return false, nil
+	}
+
+	return a.prober.Probe(ip, a.config.ConflictProbe.Timeout)
+}
+
+// markUsed flags ip as occupied within whichever range contains it,
+// optionally pinning it as persistent. It is a no-op for an ip that falls
+// outside every configured range (e.g. an out-of-pool reservation).
+func (a *Allocator) markUsed(ip net.IP, persistent bool) {
+	idx, offset, ok := a.locate(ip)
+	if !ok {
+		return
+	}
+
+	sub := a.ranges[idx]
+
+	sub.bitsetMutex.Lock()
+	sub.used.set(offset)
+	if persistent {
+		sub.persistent.set(offset)
 	}
+	sub.bitsetMutex.Unlock()
 }
@@ -19,10 +19,10 @@ func TestAllocator(t *testing.T) {
 			"1.1.1.1",
 		},
 		Gateway: "10.0.20.1",
-		DynamicRange: Range{
+		DynamicRanges: []RangeSpec{{Range: Range{
 			From: "10.0.20.50",
 			To:   "10.0.20.100",
-		},
+		}}},
 		DBFile: "test.db",
 	}
 	defer os.Remove("test.db")
@@ -38,20 +38,23 @@ func TestAllocator(t *testing.T) {
 		t.Fatalf("error creating allocator: %v", err)
 	}
 
-	ip, err := a.Allocate(testutil.FakeMAC, false, nil)
+	ip, err := a.Allocate(testutil.FakeMAC, false, nil, "")
 	if err != nil {
 		t.Fatalf("error allocating first ip: %v", err)
 	}
 
-	if ip.String() != config.DynamicRange.From {
-		t.Fatalf("Expected allocated ip was incorrect, was %v, supposed to be %v", ip, config.DynamicRange.From)
+	// an empty pool hands out the address at the MAC's hashed offset.
+	from, to := config.DynamicRanges[0].Dimensions()
+	expected := offsetIP(from, macOffset(testutil.FakeMAC, ipOffset(from, to)+1))
+	if !ip.Equal(expected) {
+		t.Fatalf("Expected allocated ip was incorrect, was %v, supposed to be %v", ip, expected)
 	}
 
-	if _, err := a.Allocate(testutil.FakeMAC, false, nil); err != nil {
+	if _, err := a.Allocate(testutil.FakeMAC, false, nil, ""); err != nil {
 		t.Fatalf("error allocating first ip: %v", err)
 	}
 
-	ip2, err := a.Allocate(testutil.FakeMAC2, false, nil)
+	ip2, err := a.Allocate(testutil.FakeMAC2, false, nil, "")
 	if err != nil {
 		t.Fatalf("Could not allocate second mac: %v", err)
 	}
@@ -71,21 +74,21 @@ func TestAllocator(t *testing.T) {
 		t.Fatal("Did not purge all leases!")
 	}
 
-	if _, err := a.Allocate(testutil.FakeMAC, false, nil); err != nil {
+	if _, err := a.Allocate(testutil.FakeMAC, false, nil, ""); err != nil {
 		t.Fatalf("error allocating first ip: %v", err)
 	}
 
-	if _, err := a.Allocate(testutil.FakeMAC2, false, nil); err != nil {
+	if _, err := a.Allocate(testutil.FakeMAC2, false, nil, ""); err != nil {
 		t.Fatalf("Could not allocate second mac: %v", err)
 	}
 
 	time.Sleep(100 * time.Millisecond)
 
-	if _, err := a.Allocate(testutil.FakeMAC, true, nil); err != nil {
+	if _, err := a.Allocate(testutil.FakeMAC, true, nil, ""); err != nil {
 		t.Fatalf("error allocating first ip: %v", err)
 	}
 
-	if _, err := a.Allocate(testutil.FakeMAC2, true, nil); err != nil {
+	if _, err := a.Allocate(testutil.FakeMAC2, true, nil, ""); err != nil {
 		t.Fatalf("Could not allocate second mac: %v", err)
 	}
 
@@ -109,10 +112,10 @@ func TestAllocatorPreferred(t *testing.T) {
 			"1.1.1.1",
 		},
 		Gateway: "10.0.20.1",
-		DynamicRange: Range{
+		DynamicRanges: []RangeSpec{{Range: Range{
 			From: "10.0.20.50",
 			To:   "10.0.20.50",
-		},
+		}}},
 		DBFile: "test.db",
 	}
 	defer os.Remove("test.db")
@@ -128,7 +131,7 @@ func TestAllocatorPreferred(t *testing.T) {
 		t.Fatalf("error creating allocator: %v", err)
 	}
 
-	ip, err := a.Allocate(testutil.FakeMAC, false, nil)
+	ip, err := a.Allocate(testutil.FakeMAC, false, nil, "")
 	if err != nil {
 		t.Fatalf("allocation failed: %v", err)
 	}
@@ -144,7 +147,7 @@ func TestAllocatorPreferred(t *testing.T) {
 		t.Fatalf("Purged lease count wasn't 1, was %d", count)
 	}
 
-	ip2, err := a.Allocate(testutil.FakeMAC, false, ip)
+	ip2, err := a.Allocate(testutil.FakeMAC, false, ip, "")
 	if err != nil {
 		t.Fatalf("allocation failed: %v", err)
 	}
@@ -165,7 +168,7 @@ func TestAllocatorPreferred(t *testing.T) {
 	}
 
 	// give out to another mac
-	ip2, err = a.Allocate(testutil.FakeMAC2, false, ip)
+	ip2, err = a.Allocate(testutil.FakeMAC2, false, ip, "")
 	if err != nil {
 		t.Fatalf("allocation failed: %v", err)
 	}
@@ -185,10 +188,10 @@ func TestAllocatorCycles(t *testing.T) {
 			"1.1.1.1",
 		},
 		Gateway: "10.0.20.1",
-		DynamicRange: Range{
+		DynamicRanges: []RangeSpec{{Range: Range{
 			From: "10.0.20.50",
 			To:   "10.0.20.50",
-		},
+		}}},
 		DBFile: "test.db",
 	}
 	defer os.Remove("test.db")
@@ -204,7 +207,7 @@ func TestAllocatorCycles(t *testing.T) {
 		t.Fatalf("error creating allocator: %v", err)
 	}
 
-	ip, err := a.Allocate(testutil.FakeMAC, false, nil)
+	ip, err := a.Allocate(testutil.FakeMAC, false, nil, "")
 	if err != nil {
 		t.Fatalf("allocation failed: %v", err)
 	}
@@ -213,7 +216,7 @@ func TestAllocatorCycles(t *testing.T) {
 		t.Fatal("IP was not allocated properly")
 	}
 
-	if _, err := a.Allocate(testutil.FakeMAC2, false, nil); err != ErrRangeExhausted {
+	if _, err := a.Allocate(testutil.FakeMAC2, false, nil, ""); err != ErrRangeExhausted {
 		if err != nil {
 			t.Logf("Error was: %v", err)
 		}
@@ -232,7 +235,7 @@ func TestAllocatorCycles(t *testing.T) {
 		t.Fatal("Did not purge all leases!")
 	}
 
-	if _, err := a.Allocate(testutil.FakeMAC2, false, nil); err != nil {
+	if _, err := a.Allocate(testutil.FakeMAC2, false, nil, ""); err != nil {
 		t.Fatalf("Could not allocate against other mac after purge: %v", err)
 	}
 }
@@ -248,10 +251,10 @@ func TestAllocatorGaps(t *testing.T) {
 			"1.1.1.1",
 		},
 		Gateway: "10.0.20.1",
-		DynamicRange: Range{
+		DynamicRanges: []RangeSpec{{Range: Range{
 			From: "10.0.20.50",
 			To:   "10.0.20.59",
-		},
+		}}},
 		DBFile: "test.db",
 	}
 	defer os.Remove("test.db")
@@ -271,7 +274,7 @@ func TestAllocatorGaps(t *testing.T) {
 
 	for i := 0; i < 10; i++ {
 		mac := testutil.RandomMAC()
-		ip, err := a.Allocate(mac, false, nil)
+		ip, err := a.Allocate(mac, false, nil, "")
 		if err != nil {
 			t.Fatalf("Allocation failed: %v", err)
 		}
@@ -284,7 +287,7 @@ func TestAllocatorGaps(t *testing.T) {
 	time.Sleep(time.Second)
 
 	for ip, mac := range keep {
-		newip, err := a.Allocate(mac, true, nil)
+		newip, err := a.Allocate(mac, true, nil, "")
 		if err != nil {
 			t.Fatalf("Error allocating for renewal: %v", err)
 		}
@@ -305,7 +308,7 @@ func TestAllocatorGaps(t *testing.T) {
 
 	for i := 0; i < 5; i++ {
 		mac := testutil.RandomMAC()
-		ip, err := a.Allocate(mac, false, nil)
+		ip, err := a.Allocate(mac, false, nil, "")
 		if err != nil {
 			t.Fatalf("Allocation failed: %v", err)
 		}
@@ -320,20 +323,20 @@ func TestAllocatorGaps(t *testing.T) {
 	// this is needed to keep the pool from timing out while between this and
 	// that, no purge will happen so the leases are safe.
 	for _, mac := range keep {
-		_, err := a.Allocate(mac, true, nil)
+		_, err := a.Allocate(mac, true, nil, "")
 		if err != nil {
 			t.Fatalf("While refreshing ip addresses: %v", err)
 		}
 	}
 
-	if ip, err := a.Allocate(testutil.RandomMAC(), false, nil); err != ErrRangeExhausted {
+	if ip, err := a.Allocate(testutil.RandomMAC(), false, nil, ""); err != ErrRangeExhausted {
 		t.Fatalf("range was not exhausted during testing: %v", ip)
 	}
 
 	time.Sleep(time.Second)
 
 	// now this should succeed by clearing all the leases in grace period
-	if ip, err := a.Allocate(testutil.RandomMAC(), false, nil); err == ErrRangeExhausted {
+	if ip, err := a.Allocate(testutil.RandomMAC(), false, nil, ""); err == ErrRangeExhausted {
 		t.Fatalf("range was exhausted during testing: %v", ip)
 	}
 
@@ -358,10 +361,10 @@ func TestAllocatorPersistent(t *testing.T) {
 			"1.1.1.1",
 		},
 		Gateway: "10.0.20.1",
-		DynamicRange: Range{
+		DynamicRanges: []RangeSpec{{Range: Range{
 			From: "10.0.20.50",
 			To:   "10.0.20.59",
-		},
+		}}},
 		DBFile: "test.db",
 	}
 	defer os.Remove("test.db")
@@ -378,7 +381,7 @@ func TestAllocatorPersistent(t *testing.T) {
 	}
 
 	mac := testutil.RandomMAC()
-	if err := db.SetLease(mac, net.ParseIP("1.2.3.4"), false, true, time.Now(), time.Now()); err != nil {
+	if err := db.SetLease(mac, net.ParseIP("1.2.3.4"), false, true, "", time.Now(), time.Now()); err != nil {
 		t.Fatalf("Error setting lease: %v", err)
 	}
 
@@ -393,7 +396,7 @@ func TestAllocatorPersistent(t *testing.T) {
 		t.Fatal("Purged persistent lease for some reason")
 	}
 
-	ip, err := a.Allocate(mac, false, nil)
+	ip, err := a.Allocate(mac, false, nil, "")
 	if err != nil {
 		t.Fatalf("Error allocating mac: %v", err)
 	}
@@ -0,0 +1,43 @@
+package dhcpd
+
+// bitset is a simple fixed-size bit vector used by Allocator to track which
+// offsets within a dynamic range are currently occupied. It is not
+// safe for concurrent use; callers are expected to hold the owning
+// subAllocator's bitsetMutex while touching one.
+type bitset struct {
+	bits []uint64
+	size int
+}
+
+// newBitset allocates a bitset capable of tracking n offsets.
+func newBitset(n int) *bitset {
+	return &bitset{
+		bits: make([]uint64, (n+63)/64),
+		size: n,
+	}
+}
+
+func (b *bitset) set(i int) {
+	b.bits[i/64] |= 1 << uint(i%64)
+}
+
+func (b *bitset) clear(i int) {
+	b.bits[i/64] &^= 1 << uint(i%64)
+}
+
+func (b *bitset) isSet(i int) bool {
+	return b.bits[i/64]&(1<<uint(i%64)) != 0
+}
+
+// count returns the number of set bits.
+func (b *bitset) count() int {
+	count := 0
+	for _, word := range b.bits {
+		for word != 0 {
+			count++
+			word &= word - 1
+		}
+	}
+
+	return count
+}
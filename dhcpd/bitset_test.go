@@ -0,0 +1,48 @@
+package dhcpd
+
+import "testing"
+
+func TestBitsetSetClearIsSet(t *testing.T) {
+	b := newBitset(130) // spans more than two 64-bit words
+
+	for _, i := range []int{0, 1, 63, 64, 65, 129} {
+		if b.isSet(i) {
+			t.Fatalf("offset %d should start clear", i)
+		}
+
+		b.set(i)
+		if !b.isSet(i) {
+			t.Fatalf("offset %d should be set after set()", i)
+		}
+	}
+
+	if count := b.count(); count != 6 {
+		t.Fatalf("expected count 6, got %d", count)
+	}
+
+	b.clear(64)
+	if b.isSet(64) {
+		t.Fatal("offset 64 should be clear after clear()")
+	}
+
+	if b.isSet(0) == false || b.isSet(129) == false {
+		t.Fatal("clearing one offset should not disturb others")
+	}
+
+	if count := b.count(); count != 5 {
+		t.Fatalf("expected count 5 after clear, got %d", count)
+	}
+}
+
+func TestBitsetWordBoundary(t *testing.T) {
+	b := newBitset(64)
+
+	b.set(63)
+	if !b.isSet(63) {
+		t.Fatal("last bit of a single word should be settable")
+	}
+
+	if b.isSet(0) {
+		t.Fatal("setting the last bit of a word must not set the first")
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/erikh/go-transport"
 	"github.com/erikh/ldhcpd/db"
+	"github.com/erikh/ldhcpd/v6"
 	"github.com/krolaw/dhcp4"
 	"github.com/pkg/errors"
 	"gopkg.in/yaml.v3"
@@ -19,6 +22,9 @@ const (
 	defaultCAFile        = "/etc/ldhcpd/rootCA.pem"
 	defaultCertFile      = "/etc/ldhcpd/server.pem"
 	defaultKeyFile       = "/etc/ldhcpd/server.key"
+
+	defaultConflictProbeTimeout = 500 * time.Millisecond
+	defaultConflictBlacklistTTL = time.Minute
 )
 
 // Range is for IP ranges
@@ -55,15 +61,165 @@ type Lease struct {
 	GracePeriod time.Duration `yaml:"grace_period"`
 }
 
+// ClientFilter optionally restricts which client requests a RangeSpec's
+// sub-allocator will consider. A nil or zero-value filter matches
+// everything.
+type ClientFilter struct {
+	// OUIPrefixes restricts matches to MAC addresses whose string form
+	// (e.g. "00:11:22:33:44:55") starts with one of these prefixes.
+	OUIPrefixes []string `yaml:"oui_prefixes"`
+	// HostnameGlob, if set, restricts matches to a client-supplied
+	// hostname matching this path.Match-style glob, e.g. "guest-*".
+	HostnameGlob string `yaml:"hostname_glob"`
+}
+
+// Matches reports whether mac/hostname satisfy f. A nil filter always
+// matches.
+func (f *ClientFilter) Matches(mac net.HardwareAddr, hostname string) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.OUIPrefixes) > 0 {
+		macStr := strings.ToLower(mac.String())
+
+		matched := false
+		for _, prefix := range f.OUIPrefixes {
+			if strings.HasPrefix(macStr, strings.ToLower(prefix)) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	if f.HostnameGlob != "" {
+		matched, err := path.Match(f.HostnameGlob, hostname)
+		if err != nil || !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RangeSpec is a single dynamic range within Config.DynamicRanges, with its
+// own optional lease overrides and client eligibility filter.
+type RangeSpec struct {
+	Range `yaml:",inline"`
+
+	// Lease, if set, overrides Config.Lease for addresses drawn from this
+	// range.
+	Lease *Lease `yaml:"lease,omitempty"`
+	// Tag identifies this range for static reservations (Reservation.RangeTag
+	// binds a reservation's IP to the range with this Tag) and for gRPC
+	// selection (ListLeasesRequest.range_tag), e.g. "guest" or "vlan20".
+	Tag string `yaml:"tag"`
+	// ClientFilter, if set, restricts which requests this range will
+	// serve.
+	ClientFilter *ClientFilter `yaml:"client_filter,omitempty"`
+}
+
+// validateRanges checks that every range is individually well-formed and
+// that no two ranges overlap.
+func validateRanges(ranges []RangeSpec) error {
+	if len(ranges) == 0 {
+		return errors.New("at least one dynamic range is required")
+	}
+
+	type bound struct {
+		from, to net.IP
+		tag      string
+	}
+
+	var bounds []bound
+
+	for i, rs := range ranges {
+		if err := rs.Range.validate(); err != nil {
+			return errors.Wrapf(err, "range %d (%v)", i, rs.Tag)
+		}
+
+		from, to := rs.Dimensions()
+
+		for _, b := range bounds {
+			if rangesOverlap(from, to, b.from, b.to) {
+				return errors.Errorf("range %d (%v) overlaps range tagged %v", i, rs.Tag, b.tag)
+			}
+		}
+
+		bounds = append(bounds, bound{from: from, to: to, tag: rs.Tag})
+	}
+
+	return nil
+}
+
+func rangesOverlap(aFrom, aTo, bFrom, bTo net.IP) bool {
+	return !(dhcp4.IPLess(aTo, bFrom) || dhcp4.IPLess(bTo, aFrom))
+}
+
+// findRangeByTag returns the RangeSpec tagged tag, if any. Used to resolve a
+// Reservation.RangeTag or ListLeasesRequest.range_tag against the configured
+// dynamic ranges.
+func findRangeByTag(ranges []RangeSpec, tag string) (RangeSpec, bool) {
+	for _, rs := range ranges {
+		if rs.Tag == tag {
+			return rs, true
+		}
+	}
+
+	return RangeSpec{}, false
+}
+
+// ConflictProbe configures on-wire conflict detection that runs before a
+// dynamically-chosen address is committed to the lease table.
+type ConflictProbe struct {
+	Enabled bool          `yaml:"enabled"`
+	Timeout time.Duration `yaml:"timeout"`
+	// Method is "icmp". "arp" and "both" are reserved for when arpProbe is
+	// implemented; until then they are rejected by validate() rather than
+	// silently running as a no-op check.
+	Method string `yaml:"method"`
+	// BlacklistTTL is how long an address that failed a probe is kept out
+	// of rotation before it is eligible to be offered again.
+	BlacklistTTL time.Duration `yaml:"blacklist_ttl"`
+}
+
+func (c ConflictProbe) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+
+	switch c.Method {
+	case "icmp":
+	case "arp", "both":
+		return errors.Errorf("conflict probe method %q is not yet implemented (arpProbe is a stub)", c.Method)
+	default:
+		return errors.Errorf("invalid conflict probe method %q", c.Method)
+	}
+
+	return nil
+}
+
 // Config is the configuration of the dhcpd service
 type Config struct {
-	DNSServers   []string `yaml:"dns_servers"`
-	Gateway      string   `yaml:"gateway"`
-	DBFile       string   `yaml:"db_file"`
-	DynamicRange Range    `yaml:"dynamic_range"`
-	Lease        Lease    `yaml:"lease"`
+	DNSServers    []string    `yaml:"dns_servers"`
+	Gateway       string      `yaml:"gateway"`
+	Netmask       string      `yaml:"netmask"`
+	DBFile        string      `yaml:"db_file"`
+	DynamicRanges []RangeSpec `yaml:"dynamic_ranges"`
+	Lease         Lease       `yaml:"lease"`
+
+	Reservations []Reservation `yaml:"reservations"`
+
+	// V6 enables the dual-stack DHCPv6 server alongside this v4 one. It is
+	// left nil to run v4-only.
+	V6 *v6.Config `yaml:"v6"`
 
-	Certificate Certificate `yaml:"certificate"`
+	ConflictProbe ConflictProbe `yaml:"conflict_probe"`
+	Certificate   Certificate   `yaml:"certificate"`
 }
 
 // ParseConfig parses the configuration in the file and returns it.
@@ -83,14 +239,42 @@ func ParseConfig(filename string) (Config, error) {
 }
 
 func (c *Config) validateAndFix() error {
-	if err := c.DynamicRange.validate(); err != nil {
-		return errors.Wrap(err, "could not validate dynamic range")
+	if err := validateRanges(c.DynamicRanges); err != nil {
+		return errors.Wrap(err, "could not validate dynamic ranges")
+	}
+
+	if err := c.ConflictProbe.validate(); err != nil {
+		return errors.Wrap(err, "could not validate conflict probe")
+	}
+
+	if c.ConflictProbe.Timeout == 0 {
+		c.ConflictProbe.Timeout = defaultConflictProbeTimeout
+	}
+
+	if c.ConflictProbe.BlacklistTTL == 0 {
+		c.ConflictProbe.BlacklistTTL = defaultConflictBlacklistTTL
 	}
 
 	if len(c.GatewayIP()) != 4 {
 		return errors.New("gateway IP is invalid")
 	}
 
+	if c.V6 != nil {
+		if err := c.V6.Validate(); err != nil {
+			return errors.Wrap(err, "could not validate v6 configuration")
+		}
+	}
+
+	if len(c.Reservations) > 0 {
+		if len(c.NetmaskIP()) != 4 {
+			return errors.New("netmask is invalid or missing, but required by reservations")
+		}
+
+		if err := c.validateReservations(); err != nil {
+			return errors.Wrap(err, "could not validate reservations")
+		}
+	}
+
 	if len(c.DNSServers) == 0 {
 		c.DNSServers = []string{}
 	}
@@ -127,6 +311,16 @@ func (c Config) GatewayIP() net.IP {
 	return net.ParseIP(c.Gateway).To4()
 }
 
+// NetmaskIP returns the subnet mask as a 4-byte IP-shaped mask.
+func (c Config) NetmaskIP() net.IP {
+	return net.ParseIP(c.Netmask).To4()
+}
+
+// Subnet returns the interface's subnet, derived from Gateway and Netmask.
+func (c Config) Subnet() *net.IPNet {
+	return &net.IPNet{IP: c.GatewayIP(), Mask: net.IPMask(c.NetmaskIP())}
+}
+
 // DNS returns the IP addresses associated with the DNS servers.
 func (c Config) DNS() []net.IP {
 	ips := []net.IP{}
@@ -0,0 +1,104 @@
+package dhcpd
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/erikh/ldhcpd/testutil"
+)
+
+// fakeProber reports a conflict for every IP in conflictIPs and is silent
+// (no conflict, no error) for everything else.
+type fakeProber struct {
+	conflictIPs map[string]bool
+}
+
+func (f *fakeProber) Probe(ip net.IP, timeout time.Duration) (bool, error) {
+	return f.conflictIPs[ip.String()], nil
+}
+
+func TestConflictProbeValidateRejectsUnimplementedMethods(t *testing.T) {
+	cases := []struct {
+		method string
+		ok     bool
+	}{
+		{"icmp", true},
+		{"arp", false},
+		{"both", false},
+		{"bogus", false},
+	}
+
+	for _, c := range cases {
+		err := ConflictProbe{Enabled: true, Method: c.method}.validate()
+		if c.ok && err != nil {
+			t.Errorf("method %q: expected no error, got %v", c.method, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("method %q: expected an error, got none", c.method)
+		}
+	}
+
+	if err := (ConflictProbe{Enabled: false, Method: "arp"}).validate(); err != nil {
+		t.Fatalf("a disabled probe should validate regardless of method, got %v", err)
+	}
+}
+
+func TestAllocatorBlacklistsOnProbeConflict(t *testing.T) {
+	config := Config{
+		Lease:   Lease{Duration: time.Minute},
+		Gateway: "10.0.20.1",
+		DynamicRanges: []RangeSpec{{Range: Range{
+			From: "10.0.20.50",
+			To:   "10.0.20.52",
+		}}},
+		ConflictProbe: ConflictProbe{
+			Enabled:      true,
+			Method:       "icmp",
+			BlacklistTTL: time.Hour,
+		},
+		DBFile: "test-conflict-probe.db",
+	}
+	defer os.Remove("test-conflict-probe.db")
+
+	db, err := config.NewDB()
+	if err != nil {
+		t.Fatalf("error creating database: %v", err)
+	}
+	defer db.Close()
+
+	a, err := NewAllocator(db, config, nil)
+	if err != nil {
+		t.Fatalf("error creating allocator: %v", err)
+	}
+
+	// force a conflict on the address FakeMAC's scan starts from, so the
+	// first candidate the allocator tries is always the one that fails.
+	from, to := config.DynamicRanges[0].Dimensions()
+	conflictIP := offsetIP(from, macOffset(testutil.FakeMAC, ipOffset(from, to)+1)).String()
+	a.prober = &fakeProber{conflictIPs: map[string]bool{conflictIP: true}}
+
+	ip, err := a.Allocate(testutil.FakeMAC, false, nil, "")
+	if err != nil {
+		t.Fatalf("error allocating ip: %v", err)
+	}
+
+	if ip.String() == conflictIP {
+		t.Fatal("allocator handed out an address that failed its conflict probe")
+	}
+
+	sub := a.ranges[0]
+	idx, offset, ok := a.locate(net.ParseIP(conflictIP))
+	if !ok {
+		t.Fatal("could not locate blacklisted offset")
+	}
+
+	if _, blacklisted := a.ranges[idx].blacklist[offset]; !blacklisted {
+		t.Fatal("offset that failed its conflict probe should be blacklisted")
+	}
+
+	if sub.used.isSet(offset) {
+		t.Fatal("blacklisted offset should have been cleared from used, not left set")
+	}
+}
@@ -0,0 +1,80 @@
+package dhcpd
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/erikh/ldhcpd/testutil"
+)
+
+func TestValidateRangesRejectsOverlap(t *testing.T) {
+	ranges := []RangeSpec{
+		{Range: Range{From: "10.0.20.10", To: "10.0.20.50"}, Tag: "main"},
+		{Range: Range{From: "10.0.20.40", To: "10.0.20.60"}, Tag: "guest"},
+	}
+
+	if err := validateRanges(ranges); err == nil {
+		t.Fatal("expected overlapping ranges to be rejected")
+	}
+
+	ranges[1].Range = Range{From: "10.0.20.51", To: "10.0.20.60"}
+	if err := validateRanges(ranges); err != nil {
+		t.Fatalf("expected adjacent, non-overlapping ranges to validate, got %v", err)
+	}
+}
+
+func TestAllocatorDispatchesByClientFilter(t *testing.T) {
+	config := Config{
+		Lease:   Lease{Duration: time.Hour},
+		Gateway: "10.0.20.1",
+		DynamicRanges: []RangeSpec{
+			{
+				Range:        Range{From: "10.0.20.10", To: "10.0.20.10"},
+				Tag:          "guest",
+				ClientFilter: &ClientFilter{HostnameGlob: "guest-*"},
+			},
+			{
+				Range: Range{From: "10.0.30.10", To: "10.0.30.10"},
+				Tag:   "main",
+			},
+		},
+		DBFile: "test-ranges.db",
+	}
+	defer os.Remove("test-ranges.db")
+
+	db, err := config.NewDB()
+	if err != nil {
+		t.Fatalf("error creating database: %v", err)
+	}
+	defer db.Close()
+
+	a, err := NewAllocator(db, config, nil)
+	if err != nil {
+		t.Fatalf("error creating allocator: %v", err)
+	}
+
+	ip, err := a.Allocate(testutil.FakeMAC, false, nil, "guest-laptop")
+	if err != nil {
+		t.Fatalf("error allocating for guest hostname: %v", err)
+	}
+	if ip.String() != "10.0.20.10" {
+		t.Fatalf("expected guest-matching hostname to land in the guest range, got %v", ip)
+	}
+
+	ip2, err := a.Allocate(testutil.FakeMAC2, false, nil, "corp-desktop")
+	if err != nil {
+		t.Fatalf("error allocating for non-guest hostname: %v", err)
+	}
+	if ip2.String() != "10.0.30.10" {
+		t.Fatalf("expected non-matching hostname to fall through to the unfiltered range, got %v", ip2)
+	}
+
+	leases, _, err := a.ListLeases(LeaseFilter{RangeTag: "guest"})
+	if err != nil {
+		t.Fatalf("ListLeases error: %v", err)
+	}
+	if len(leases) != 1 || leases[0].IP().String() != "10.0.20.10" {
+		t.Fatalf("expected RangeTag %q to filter down to the guest-range lease, got %v", "guest", leases)
+	}
+}
@@ -0,0 +1,262 @@
+package dhcpd
+
+import (
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+	"github.com/pkg/errors"
+)
+
+// hostnameRE matches a single RFC 1123 DNS label.
+var hostnameRE = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9\-]{0,61}[a-zA-Z0-9])?$`)
+
+// Reservation binds a MAC address to a specific IP (and optional hostname),
+// independent of DynamicRanges. Reservations are installed into the lease
+// table as persistent leases the first time the bound MAC is seen.
+type Reservation struct {
+	MAC      string `yaml:"mac"`
+	IP       string `yaml:"ip"`
+	Hostname string `yaml:"hostname"`
+	// RangeTag, if set, binds this reservation to the DynamicRanges entry
+	// with a matching Tag: the IP must fall within that range, and a
+	// RangeTag-filtered ListLeases call will only surface it there.
+	RangeTag      string        `yaml:"range_tag"`
+	LeaseDuration time.Duration `yaml:"lease_duration"`
+}
+
+func (r Reservation) validate() error {
+	if _, err := net.ParseMAC(r.MAC); err != nil {
+		return errors.Wrapf(err, "invalid MAC %q in reservation", r.MAC)
+	}
+
+	if net.ParseIP(r.IP).To4() == nil {
+		return errors.Errorf("invalid IP %q in reservation", r.IP)
+	}
+
+	if r.Hostname != "" && !hostnameRE.MatchString(r.Hostname) {
+		return errors.Errorf("invalid hostname %q in reservation", r.Hostname)
+	}
+
+	return nil
+}
+
+// validateReservations checks that every reservation is well-formed, falls
+// within the interface's subnet, and does not collide with another
+// reservation on MAC or IP.
+func (c *Config) validateReservations() error {
+	subnet := c.Subnet()
+
+	macs := map[string]bool{}
+	ips := map[string]string{}
+
+	for i, r := range c.Reservations {
+		if err := r.validate(); err != nil {
+			return errors.Wrapf(err, "reservation %d", i)
+		}
+
+		mac, _ := net.ParseMAC(r.MAC)
+		if macs[mac.String()] {
+			return errors.Errorf("duplicate reservation for MAC %v", mac)
+		}
+		macs[mac.String()] = true
+
+		ip := net.ParseIP(r.IP).To4()
+		if !subnet.Contains(ip) {
+			return errors.Errorf("reservation IP %v is not within subnet %v", ip, subnet)
+		}
+
+		if r.RangeTag != "" {
+			rs, ok := findRangeByTag(c.DynamicRanges, r.RangeTag)
+			if !ok {
+				return errors.Errorf("reservation %d is tagged %q, which matches no dynamic range", i, r.RangeTag)
+			}
+
+			from, to := rs.Dimensions()
+			if !dhcp4.IPInRange(from, to, ip) {
+				return errors.Errorf("reservation IP %v does not fall within range %q (%v)", ip, r.RangeTag, rs.Range)
+			}
+		}
+
+		if other, ok := ips[ip.String()]; ok {
+			return errors.Errorf("reservation IP %v is bound to both %v and %v", ip, other, mac)
+		}
+		ips[ip.String()] = mac.String()
+	}
+
+	return nil
+}
+
+// reservations indexes a set of Reservations by both MAC and IP for O(1)
+// lookup from the allocation hot path.
+type reservations struct {
+	byMAC map[string]Reservation
+	byIP  map[string]Reservation
+	mutex sync.RWMutex
+}
+
+func newReservations(initial []Reservation) *reservations {
+	r := &reservations{
+		byMAC: map[string]Reservation{},
+		byIP:  map[string]Reservation{},
+	}
+
+	for _, res := range initial {
+		r.put(res)
+	}
+
+	return r
+}
+
+func (r *reservations) put(res Reservation) {
+	mac, _ := net.ParseMAC(res.MAC)
+	ip := net.ParseIP(res.IP).To4()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.byMAC[mac.String()] = res
+	r.byIP[ip.String()] = res
+}
+
+func (r *reservations) remove(mac net.HardwareAddr) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	res, ok := r.byMAC[mac.String()]
+	if !ok {
+		return
+	}
+
+	delete(r.byMAC, mac.String())
+	delete(r.byIP, res.IP)
+}
+
+func (r *reservations) byMACAddr(mac net.HardwareAddr) (Reservation, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	res, ok := r.byMAC[mac.String()]
+	return res, ok
+}
+
+func (r *reservations) byIPAddr(ip net.IP) (Reservation, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	res, ok := r.byIP[ip.To4().String()]
+	return res, ok
+}
+
+func (r *reservations) list() []Reservation {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	out := make([]Reservation, 0, len(r.byMAC))
+	for _, res := range r.byMAC {
+		out = append(out, res)
+	}
+
+	return out
+}
+
+// AddReservation validates and registers a new static reservation. It takes
+// effect immediately: the reserved offset (if inside DynamicRanges) is
+// pulled from dynamic rotation right away, though the lease itself isn't
+// installed until the MAC is next seen by Allocate. This backs the
+// AddReservation RPC on the admin gRPC surface.
+func (a *Allocator) AddReservation(r Reservation) error {
+	if err := r.validate(); err != nil {
+		return errors.Wrap(err, "invalid reservation")
+	}
+
+	ip := net.ParseIP(r.IP).To4()
+	if !a.config.Subnet().Contains(ip) {
+		return errors.Errorf("reservation IP %v is not within subnet %v", ip, a.config.Subnet())
+	}
+
+	if r.RangeTag != "" {
+		rs, ok := findRangeByTag(a.config.DynamicRanges, r.RangeTag)
+		if !ok {
+			return errors.Errorf("reservation is tagged %q, which matches no dynamic range", r.RangeTag)
+		}
+
+		from, to := rs.Dimensions()
+		if !dhcp4.IPInRange(from, to, ip) {
+			return errors.Errorf("reservation IP %v does not fall within range %q (%v)", ip, r.RangeTag, rs.Range)
+		}
+	}
+
+	if existing, ok := a.reservations.byIPAddr(ip); ok {
+		mac, _ := net.ParseMAC(r.MAC)
+		if existing.MAC != mac.String() {
+			return errors.Errorf("reservation IP %v is already bound to %v", ip, existing.MAC)
+		}
+	}
+
+	a.reservations.put(r)
+	a.markUsed(ip, true)
+
+	return nil
+}
+
+// RemoveReservation drops a static reservation. It does not tear down a
+// lease that was already installed for the MAC; use ReleaseLease for that.
+// This backs the RemoveReservation RPC on the admin gRPC surface.
+func (a *Allocator) RemoveReservation(mac net.HardwareAddr) {
+	res, ok := a.reservations.byMACAddr(mac)
+	if !ok {
+		return
+	}
+
+	a.reservations.remove(mac)
+
+	// if the reservation's lease was never installed (the MAC hadn't been
+	// seen yet), AddReservation's markUsed left the offset pinned in
+	// "used" with no DB row behind it; clear that too, or the offset can
+	// never be dynamically handed out again until the next reload(). A
+	// lease that was installed is left alone, per this method's contract.
+	_, err := a.db.GetLease(mac)
+	hasLease := err == nil
+
+	if ip := net.ParseIP(res.IP).To4(); ip != nil {
+		if idx, offset, ok := a.locate(ip); ok {
+			sub := a.ranges[idx]
+			sub.bitsetMutex.Lock()
+			sub.persistent.clear(offset)
+			if !hasLease {
+				sub.used.clear(offset)
+			}
+			sub.bitsetMutex.Unlock()
+		}
+	}
+}
+
+// ListReservations returns all currently registered static reservations.
+// This backs the ListReservations RPC on the admin gRPC surface.
+func (a *Allocator) ListReservations() []Reservation {
+	return a.reservations.list()
+}
+
+// allocateReservation installs (or re-confirms) r's lease for mac and
+// returns its IP.
+func (a *Allocator) allocateReservation(mac net.HardwareAddr, r Reservation, now time.Time) (net.IP, error) {
+	ip := net.ParseIP(r.IP).To4()
+
+	duration := r.LeaseDuration
+	if duration == 0 {
+		duration = a.config.Lease.Duration
+	}
+	leaseEnd := now.Add(duration)
+
+	if err := a.db.SetLease(mac, ip, false, true, r.Hostname, leaseEnd, leaseEnd); err != nil {
+		return nil, errors.Wrapf(err, "could not install reservation for mac [%v]", mac)
+	}
+
+	a.markUsed(ip, true)
+	a.publish(LeaseEvent{Type: EventLeaseAdded, MAC: mac, IP: ip, Hostname: r.Hostname, At: now})
+
+	return ip, nil
+}
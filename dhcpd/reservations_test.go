@@ -0,0 +1,202 @@
+package dhcpd
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/erikh/ldhcpd/testutil"
+)
+
+func TestReservationValidate(t *testing.T) {
+	cases := []struct {
+		name string
+		r    Reservation
+		ok   bool
+	}{
+		{"valid", Reservation{MAC: "aa:bb:cc:dd:ee:ff", IP: "10.0.20.10", Hostname: "printer-1"}, true},
+		{"bad mac", Reservation{MAC: "not-a-mac", IP: "10.0.20.10"}, false},
+		{"bad ip", Reservation{MAC: "aa:bb:cc:dd:ee:ff", IP: "not-an-ip"}, false},
+		{"bad hostname", Reservation{MAC: "aa:bb:cc:dd:ee:ff", IP: "10.0.20.10", Hostname: "-bad-"}, false},
+	}
+
+	for _, c := range cases {
+		err := c.r.validate()
+		if c.ok && err != nil {
+			t.Errorf("%s: expected no error, got %v", c.name, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%s: expected an error, got none", c.name)
+		}
+	}
+}
+
+func TestValidateReservationsCollisions(t *testing.T) {
+	base := Config{
+		Gateway: "10.0.20.1",
+		Netmask: "255.255.255.0",
+	}
+
+	base.Reservations = []Reservation{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.20.10"},
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.20.11"},
+	}
+	if err := base.validateReservations(); err == nil {
+		t.Fatal("expected a duplicate-MAC error")
+	}
+
+	base.Reservations = []Reservation{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.20.10"},
+		{MAC: "aa:bb:cc:dd:ee:02", IP: "10.0.20.10"},
+	}
+	if err := base.validateReservations(); err == nil {
+		t.Fatal("expected a duplicate-IP error")
+	}
+
+	base.Reservations = []Reservation{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.30.10"},
+	}
+	if err := base.validateReservations(); err == nil {
+		t.Fatal("expected an out-of-subnet error")
+	}
+
+	base.Reservations = []Reservation{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.20.10"},
+		{MAC: "aa:bb:cc:dd:ee:02", IP: "10.0.20.11"},
+	}
+	if err := base.validateReservations(); err != nil {
+		t.Fatalf("expected no error for non-colliding reservations, got %v", err)
+	}
+}
+
+func TestValidateReservationsRangeTag(t *testing.T) {
+	base := Config{
+		Gateway: "10.0.20.1",
+		Netmask: "255.255.255.0",
+		DynamicRanges: []RangeSpec{
+			{Range: Range{From: "10.0.20.50", To: "10.0.20.60"}, Tag: "guest"},
+		},
+	}
+
+	base.Reservations = []Reservation{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.20.55", RangeTag: "guest"},
+	}
+	if err := base.validateReservations(); err != nil {
+		t.Fatalf("expected a reservation within its tagged range to validate, got %v", err)
+	}
+
+	base.Reservations = []Reservation{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.20.10", RangeTag: "guest"},
+	}
+	if err := base.validateReservations(); err == nil {
+		t.Fatal("expected a reservation outside its tagged range's bounds to be rejected")
+	}
+
+	base.Reservations = []Reservation{
+		{MAC: "aa:bb:cc:dd:ee:01", IP: "10.0.20.55", RangeTag: "does-not-exist"},
+	}
+	if err := base.validateReservations(); err == nil {
+		t.Fatal("expected a reservation tagged with an unknown range to be rejected")
+	}
+}
+
+func TestRemoveReservationClearsUsedForAnUninstalledReservation(t *testing.T) {
+	config := Config{
+		Lease:   Lease{Duration: time.Hour},
+		Gateway: "10.0.20.1",
+		Netmask: "255.255.255.0",
+		DynamicRanges: []RangeSpec{{Range: Range{
+			From: "10.0.20.50",
+			To:   "10.0.20.60",
+		}}},
+		DBFile: "test-remove-reservation.db",
+	}
+	defer os.Remove("test-remove-reservation.db")
+
+	db, err := config.NewDB()
+	if err != nil {
+		t.Fatalf("error creating database: %v", err)
+	}
+	defer db.Close()
+
+	a, err := NewAllocator(db, config, nil)
+	if err != nil {
+		t.Fatalf("error creating allocator: %v", err)
+	}
+
+	reservedIP := net.ParseIP("10.0.20.55")
+	if err := a.AddReservation(Reservation{MAC: testutil.FakeMAC.String(), IP: reservedIP.String()}); err != nil {
+		t.Fatalf("error adding reservation: %v", err)
+	}
+
+	idx, offset, ok := a.locate(reservedIP)
+	if !ok {
+		t.Fatal("could not locate reserved offset")
+	}
+	if !a.ranges[idx].used.isSet(offset) {
+		t.Fatal("AddReservation should have marked its offset used")
+	}
+
+	// the MAC was never seen, so no lease backs this reservation yet;
+	// removing it must free the offset back to dynamic rotation.
+	a.RemoveReservation(testutil.FakeMAC)
+
+	if a.ranges[idx].used.isSet(offset) {
+		t.Fatal("RemoveReservation left an uninstalled reservation's offset permanently used")
+	}
+	if a.ranges[idx].persistent.isSet(offset) {
+		t.Fatal("RemoveReservation should have cleared persistent too")
+	}
+}
+
+func TestAllocatorReservationDurationSurvivesRenewal(t *testing.T) {
+	const reservedDuration = 30 * time.Second
+
+	config := Config{
+		Lease:   Lease{Duration: time.Hour},
+		Gateway: "10.0.20.1",
+		Netmask: "255.255.255.0",
+		DynamicRanges: []RangeSpec{{Range: Range{
+			From: "10.0.20.50",
+			To:   "10.0.20.60",
+		}}},
+		Reservations: []Reservation{
+			{MAC: testutil.FakeMAC.String(), IP: "10.0.20.10", LeaseDuration: reservedDuration},
+		},
+		DBFile: "test-reservation-duration.db",
+	}
+	defer os.Remove("test-reservation-duration.db")
+
+	db, err := config.NewDB()
+	if err != nil {
+		t.Fatalf("error creating database: %v", err)
+	}
+	defer db.Close()
+
+	a, err := NewAllocator(db, config, nil)
+	if err != nil {
+		t.Fatalf("error creating allocator: %v", err)
+	}
+
+	if _, err := a.Allocate(testutil.FakeMAC, false, nil, ""); err != nil {
+		t.Fatalf("error installing reservation lease: %v", err)
+	}
+
+	// a persistent lease renews on every Allocate call; check that the
+	// reservation's own LeaseDuration keeps being used instead of
+	// reverting to the global default.
+	if _, err := a.Allocate(testutil.FakeMAC, false, nil, ""); err != nil {
+		t.Fatalf("error renewing reservation lease: %v", err)
+	}
+
+	l, err := db.GetLease(testutil.FakeMAC)
+	if err != nil {
+		t.Fatalf("error fetching lease: %v", err)
+	}
+
+	remaining := time.Until(l.LeaseEnd)
+	if remaining > reservedDuration || remaining < reservedDuration-5*time.Second {
+		t.Fatalf("expected lease end to reflect the reservation's %v duration, got %v remaining", reservedDuration, remaining)
+	}
+}
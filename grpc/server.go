@@ -0,0 +1,236 @@
+// Package grpc adapts dhcpd.Allocator's lease administration methods to the
+// Admin gRPC service defined in admin.proto.
+package grpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/erikh/ldhcpd/db"
+	"github.com/erikh/ldhcpd/dhcpd"
+	"github.com/erikh/ldhcpd/grpc/adminpb"
+	"github.com/erikh/ldhcpd/v6"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// AdminServer implements adminpb.AdminServer against an Allocator.
+type AdminServer struct {
+	adminpb.UnimplementedAdminServer
+
+	allocator   *dhcpd.Allocator
+	v6Allocator *v6.Allocator
+}
+
+// NewAdminServer wraps allocator for registration against a grpc.Server.
+func NewAdminServer(allocator *dhcpd.Allocator) *AdminServer {
+	return &AdminServer{allocator: allocator}
+}
+
+// NewDualStackAdminServer wraps allocator and v6Allocator, so ListLeases can
+// surface a combined view of v4 and v6 leases for the same host. Use this
+// instead of NewAdminServer when Config.V6 is set.
+func NewDualStackAdminServer(allocator *dhcpd.Allocator, v6Allocator *v6.Allocator) *AdminServer {
+	return &AdminServer{allocator: allocator, v6Allocator: v6Allocator}
+}
+
+// ListLeases implements adminpb.AdminServer.
+func (s *AdminServer) ListLeases(ctx context.Context, req *adminpb.ListLeasesRequest) (*adminpb.ListLeasesResponse, error) {
+	leases, nextPageToken, err := s.allocator.ListLeases(dhcpd.LeaseFilter{
+		MACPrefix:      req.MacPrefix,
+		IPFrom:         net.ParseIP(req.IpRangeFrom),
+		IPTo:           net.ParseIP(req.IpRangeTo),
+		PersistentOnly: req.PersistentOnly,
+		ExpiredOnly:    req.ExpiredOnly,
+		RangeTag:       req.RangeTag,
+		PageSize:       int(req.PageSize),
+		PageToken:      req.PageToken,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &adminpb.ListLeasesResponse{NextPageToken: nextPageToken}
+	for _, l := range leases {
+		resp.Leases = append(resp.Leases, leaseToProto(l))
+	}
+
+	// v6 has no pagination cursor of its own; attach the full v6 lease set
+	// to the first page only, rather than repeating it on every page of
+	// the v4 pagination loop.
+	if req.IncludeV6 && s.v6Allocator != nil && req.PageToken == "" {
+		v6Leases, err := s.v6Allocator.ListLeases()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, l := range v6Leases {
+			resp.Leases = append(resp.Leases, v6LeaseToProto(l))
+		}
+	}
+
+	return resp, nil
+}
+
+// ReleaseLease implements adminpb.AdminServer.
+func (s *AdminServer) ReleaseLease(ctx context.Context, req *adminpb.ReleaseLeaseRequest) (*adminpb.ReleaseLeaseResponse, error) {
+	mac, err := net.ParseMAC(req.Mac)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid mac %q", req.Mac)
+	}
+
+	if err := s.allocator.ReleaseLease(mac); err != nil {
+		return nil, err
+	}
+
+	return &adminpb.ReleaseLeaseResponse{}, nil
+}
+
+// PurgeExpired implements adminpb.AdminServer.
+func (s *AdminServer) PurgeExpired(ctx context.Context, req *adminpb.PurgeExpiredRequest) (*adminpb.PurgeExpiredResponse, error) {
+	count, err := s.allocator.PurgeExpired(req.IncludeGrace)
+	if err != nil {
+		return nil, err
+	}
+
+	return &adminpb.PurgeExpiredResponse{Purged: int32(count)}, nil
+}
+
+// SetPersistent implements adminpb.AdminServer.
+func (s *AdminServer) SetPersistent(ctx context.Context, req *adminpb.SetPersistentRequest) (*adminpb.SetPersistentResponse, error) {
+	mac, err := net.ParseMAC(req.Mac)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid mac %q", req.Mac)
+	}
+
+	if err := s.allocator.SetPersistent(mac, req.Persistent); err != nil {
+		return nil, err
+	}
+
+	return &adminpb.SetPersistentResponse{}, nil
+}
+
+// AddReservation implements adminpb.AdminServer.
+func (s *AdminServer) AddReservation(ctx context.Context, req *adminpb.AddReservationRequest) (*adminpb.AddReservationResponse, error) {
+	if err := s.allocator.AddReservation(reservationFromProto(req.Reservation)); err != nil {
+		return nil, err
+	}
+
+	return &adminpb.AddReservationResponse{}, nil
+}
+
+// RemoveReservation implements adminpb.AdminServer.
+func (s *AdminServer) RemoveReservation(ctx context.Context, req *adminpb.RemoveReservationRequest) (*adminpb.RemoveReservationResponse, error) {
+	mac, err := net.ParseMAC(req.Mac)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid mac %q", req.Mac)
+	}
+
+	s.allocator.RemoveReservation(mac)
+
+	return &adminpb.RemoveReservationResponse{}, nil
+}
+
+// ListReservations implements adminpb.AdminServer.
+func (s *AdminServer) ListReservations(ctx context.Context, req *adminpb.ListReservationsRequest) (*adminpb.ListReservationsResponse, error) {
+	resp := &adminpb.ListReservationsResponse{}
+	for _, r := range s.allocator.ListReservations() {
+		resp.Reservations = append(resp.Reservations, reservationToProto(r))
+	}
+
+	return resp, nil
+}
+
+// Stats implements adminpb.AdminServer.
+func (s *AdminServer) Stats(ctx context.Context, req *adminpb.StatsRequest) (*adminpb.StatsResponse, error) {
+	total, used, persistent := s.allocator.Stats()
+
+	return &adminpb.StatsResponse{
+		Total:      int32(total),
+		Used:       int32(used),
+		Persistent: int32(persistent),
+	}, nil
+}
+
+// WatchLeases implements adminpb.AdminServer.
+func (s *AdminServer) WatchLeases(req *adminpb.WatchLeasesRequest, stream adminpb.Admin_WatchLeasesServer) error {
+	events, cancel := s.allocator.Watch()
+	defer cancel()
+
+	for {
+		select {
+		case event := <-events:
+			if err := stream.Send(eventToProto(event)); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func leaseToProto(l db.Lease) *adminpb.Lease {
+	return &adminpb.Lease{
+		Family:        adminpb.Family_V4,
+		Mac:           l.Mac.String(),
+		Ip:            l.IP().String(),
+		Hostname:      l.Hostname,
+		Persistent:    l.Persistent,
+		LeaseEnd:      timestamppb.New(l.LeaseEnd),
+		LeaseGraceEnd: timestamppb.New(l.LeaseGraceEnd),
+	}
+}
+
+// v6LeaseToProto adapts a V6Lease, which has no MAC or persistence concept,
+// to the same Lease message used for v4 so ListLeases can return both
+// families in one response.
+func v6LeaseToProto(l db.V6Lease) *adminpb.Lease {
+	return &adminpb.Lease{
+		Family:        adminpb.Family_V6,
+		Duid:          fmt.Sprintf("%x", l.Duid),
+		Iaid:          fmt.Sprintf("%x", l.Iaid),
+		Ip:            l.IP().String(),
+		LeaseEnd:      timestamppb.New(l.LeaseEnd),
+		LeaseGraceEnd: timestamppb.New(l.LeaseGraceEnd),
+	}
+}
+
+func reservationToProto(r dhcpd.Reservation) *adminpb.Reservation {
+	return &adminpb.Reservation{
+		Mac:                  r.MAC,
+		Ip:                   r.IP,
+		Hostname:             r.Hostname,
+		LeaseDurationSeconds: int64(r.LeaseDuration.Seconds()),
+		RangeTag:             r.RangeTag,
+	}
+}
+
+func reservationFromProto(r *adminpb.Reservation) dhcpd.Reservation {
+	return dhcpd.Reservation{
+		MAC:           r.Mac,
+		IP:            r.Ip,
+		Hostname:      r.Hostname,
+		LeaseDuration: time.Duration(r.LeaseDurationSeconds) * time.Second,
+		RangeTag:      r.RangeTag,
+	}
+}
+
+func eventToProto(e dhcpd.LeaseEvent) *adminpb.LeaseEvent {
+	pe := &adminpb.LeaseEvent{
+		Type:        adminpb.LeaseEvent_Type(e.Type),
+		At:          timestamppb.New(e.At),
+		PurgedCount: int32(e.Count),
+	}
+
+	if e.MAC != nil {
+		pe.Lease = &adminpb.Lease{
+			Mac:      e.MAC.String(),
+			Ip:       e.IP.String(),
+			Hostname: e.Hostname,
+		}
+	}
+
+	return pe
+}
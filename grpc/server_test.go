@@ -0,0 +1,296 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/erikh/ldhcpd/dhcpd"
+	"github.com/erikh/ldhcpd/grpc/adminpb"
+	"github.com/erikh/ldhcpd/testutil"
+	"github.com/erikh/ldhcpd/v6"
+	"google.golang.org/grpc"
+)
+
+func newTestAdminServer(t *testing.T, dbFile string) *AdminServer {
+	t.Helper()
+
+	config := dhcpd.Config{
+		Lease:   dhcpd.Lease{Duration: time.Hour},
+		Gateway: "10.0.20.1",
+		DynamicRanges: []dhcpd.RangeSpec{{Range: dhcpd.Range{
+			From: "10.0.20.50",
+			To:   "10.0.20.60",
+		}}},
+		DBFile: dbFile,
+	}
+
+	db, err := config.NewDB()
+	if err != nil {
+		t.Fatalf("error creating database: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.Remove(dbFile)
+	})
+
+	allocator, err := dhcpd.NewAllocator(db, config, nil)
+	if err != nil {
+		t.Fatalf("error creating allocator: %v", err)
+	}
+
+	return NewAdminServer(allocator)
+}
+
+func TestAdminServerListLeasesFiltersAndPages(t *testing.T) {
+	s := newTestAdminServer(t, "test-admin-list.db")
+	ctx := context.Background()
+
+	for _, mac := range []net.HardwareAddr{testutil.FakeMAC, testutil.FakeMAC2} {
+		if _, err := s.allocator.Allocate(mac, false, nil, ""); err != nil {
+			t.Fatalf("error allocating for %v: %v", mac, err)
+		}
+	}
+
+	resp, err := s.ListLeases(ctx, &adminpb.ListLeasesRequest{PageSize: 1})
+	if err != nil {
+		t.Fatalf("ListLeases error: %v", err)
+	}
+
+	if len(resp.Leases) != 1 {
+		t.Fatalf("expected a single-lease page, got %d", len(resp.Leases))
+	}
+	if resp.NextPageToken == "" {
+		t.Fatal("expected a next page token with more leases remaining")
+	}
+
+	resp2, err := s.ListLeases(ctx, &adminpb.ListLeasesRequest{PageSize: 1, PageToken: resp.NextPageToken})
+	if err != nil {
+		t.Fatalf("ListLeases (page 2) error: %v", err)
+	}
+
+	if len(resp2.Leases) != 1 {
+		t.Fatalf("expected the second page to hold the remaining lease, got %d", len(resp2.Leases))
+	}
+	if resp2.NextPageToken != "" {
+		t.Fatal("expected an empty next page token once every lease has been returned")
+	}
+	if resp.Leases[0].Mac == resp2.Leases[0].Mac {
+		t.Fatal("paging returned the same lease twice")
+	}
+}
+
+func TestAdminServerListLeasesIncludeV6OnlyOnFirstPage(t *testing.T) {
+	dbFile := "test-admin-v6-page.db"
+	config := dhcpd.Config{
+		Lease:   dhcpd.Lease{Duration: time.Hour},
+		Gateway: "10.0.20.1",
+		DynamicRanges: []dhcpd.RangeSpec{{Range: dhcpd.Range{
+			From: "10.0.20.50",
+			To:   "10.0.20.60",
+		}}},
+		DBFile: dbFile,
+	}
+
+	db, err := config.NewDB()
+	if err != nil {
+		t.Fatalf("error creating database: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.Remove(dbFile)
+	})
+
+	v4Allocator, err := dhcpd.NewAllocator(db, config, nil)
+	if err != nil {
+		t.Fatalf("error creating v4 allocator: %v", err)
+	}
+
+	v6Allocator, err := v6.NewAllocator(db, v6.Config{
+		Lease:        v6.Lease{Duration: time.Hour},
+		DynamicRange: v6.Range{From: "2001:db8::1", To: "2001:db8::ffff"},
+	})
+	if err != nil {
+		t.Fatalf("error creating v6 allocator: %v", err)
+	}
+
+	s := NewDualStackAdminServer(v4Allocator, v6Allocator)
+	ctx := context.Background()
+
+	for _, mac := range []net.HardwareAddr{testutil.FakeMAC, testutil.FakeMAC2} {
+		if _, err := s.allocator.Allocate(mac, false, nil, ""); err != nil {
+			t.Fatalf("error allocating v4 lease for %v: %v", mac, err)
+		}
+	}
+
+	if _, err := s.v6Allocator.Allocate([]byte{0x00, 0x01, 0xde, 0xad}, [4]byte{0, 0, 0, 1}, false); err != nil {
+		t.Fatalf("error allocating v6 lease: %v", err)
+	}
+
+	resp, err := s.ListLeases(ctx, &adminpb.ListLeasesRequest{PageSize: 1, IncludeV6: true})
+	if err != nil {
+		t.Fatalf("ListLeases (page 1) error: %v", err)
+	}
+	if resp.NextPageToken == "" {
+		t.Fatal("expected a next page token with a second v4 lease remaining")
+	}
+	if countByFamily(resp.Leases, adminpb.Family_V6) != 1 {
+		t.Fatalf("expected the v6 lease on the first page, got %d", countByFamily(resp.Leases, adminpb.Family_V6))
+	}
+
+	resp2, err := s.ListLeases(ctx, &adminpb.ListLeasesRequest{PageSize: 1, IncludeV6: true, PageToken: resp.NextPageToken})
+	if err != nil {
+		t.Fatalf("ListLeases (page 2) error: %v", err)
+	}
+	if countByFamily(resp2.Leases, adminpb.Family_V6) != 0 {
+		t.Fatalf("expected the v6 lease set to appear only on the first page, got %d more on page 2", countByFamily(resp2.Leases, adminpb.Family_V6))
+	}
+}
+
+func countByFamily(leases []*adminpb.Lease, family adminpb.Family) int {
+	count := 0
+	for _, l := range leases {
+		if l.Family == family {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestAdminServerReleaseAndSetPersistent(t *testing.T) {
+	s := newTestAdminServer(t, "test-admin-release.db")
+	ctx := context.Background()
+
+	if _, err := s.allocator.Allocate(testutil.FakeMAC, false, nil, ""); err != nil {
+		t.Fatalf("error allocating lease: %v", err)
+	}
+
+	if _, err := s.SetPersistent(ctx, &adminpb.SetPersistentRequest{Mac: testutil.FakeMAC.String(), Persistent: true}); err != nil {
+		t.Fatalf("SetPersistent error: %v", err)
+	}
+
+	resp, err := s.ListLeases(ctx, &adminpb.ListLeasesRequest{PersistentOnly: true})
+	if err != nil {
+		t.Fatalf("ListLeases error: %v", err)
+	}
+	if len(resp.Leases) != 1 {
+		t.Fatalf("expected the promoted lease to show up as persistent, got %d leases", len(resp.Leases))
+	}
+
+	if _, err := s.ReleaseLease(ctx, &adminpb.ReleaseLeaseRequest{Mac: testutil.FakeMAC.String()}); err != nil {
+		t.Fatalf("ReleaseLease error: %v", err)
+	}
+
+	resp, err = s.ListLeases(ctx, &adminpb.ListLeasesRequest{})
+	if err != nil {
+		t.Fatalf("ListLeases error: %v", err)
+	}
+	if len(resp.Leases) != 0 {
+		t.Fatalf("expected no leases after release, got %d", len(resp.Leases))
+	}
+}
+
+func TestAdminServerPurgeExpired(t *testing.T) {
+	s := NewAdminServer(mustAllocatorWithShortLease(t))
+	ctx := context.Background()
+
+	if _, err := s.allocator.Allocate(testutil.FakeMAC, false, nil, ""); err != nil {
+		t.Fatalf("error allocating lease: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	resp, err := s.PurgeExpired(ctx, &adminpb.PurgeExpiredRequest{})
+	if err != nil {
+		t.Fatalf("PurgeExpired error: %v", err)
+	}
+	if resp.Purged != 1 {
+		t.Fatalf("expected 1 purged lease, got %d", resp.Purged)
+	}
+}
+
+func mustAllocatorWithShortLease(t *testing.T) *dhcpd.Allocator {
+	t.Helper()
+
+	dbFile := "test-admin-purge.db"
+	config := dhcpd.Config{
+		Lease:   dhcpd.Lease{Duration: 10 * time.Millisecond},
+		Gateway: "10.0.20.1",
+		DynamicRanges: []dhcpd.RangeSpec{{Range: dhcpd.Range{
+			From: "10.0.20.50",
+			To:   "10.0.20.60",
+		}}},
+		DBFile: dbFile,
+	}
+
+	db, err := config.NewDB()
+	if err != nil {
+		t.Fatalf("error creating database: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.Remove(dbFile)
+	})
+
+	allocator, err := dhcpd.NewAllocator(db, config, nil)
+	if err != nil {
+		t.Fatalf("error creating allocator: %v", err)
+	}
+
+	return allocator
+}
+
+// fakeWatchStream implements adminpb.Admin_WatchLeasesServer well enough to
+// drive WatchLeases in a test: it records every sent event and reports done
+// once its context is canceled.
+type fakeWatchStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events []*adminpb.LeaseEvent
+}
+
+func (f *fakeWatchStream) Send(e *adminpb.LeaseEvent) error {
+	f.events = append(f.events, e)
+	return nil
+}
+
+func (f *fakeWatchStream) Context() context.Context {
+	return f.ctx
+}
+
+func TestAdminServerWatchLeasesStreamsEvents(t *testing.T) {
+	s := newTestAdminServer(t, "test-admin-watch.db")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &fakeWatchStream{ctx: ctx}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.WatchLeases(&adminpb.WatchLeasesRequest{}, stream)
+	}()
+
+	if _, err := s.allocator.Allocate(testutil.FakeMAC, false, nil, ""); err != nil {
+		t.Fatalf("error allocating lease: %v", err)
+	}
+
+	// give the watcher goroutine a moment to receive and forward the
+	// publish before tearing the stream down.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("WatchLeases did not return after its context was canceled")
+	}
+
+	if len(stream.events) != 1 {
+		t.Fatalf("expected 1 streamed event, got %d", len(stream.events))
+	}
+	if stream.events[0].Type != adminpb.LeaseEvent_ADDED {
+		t.Fatalf("expected an ADDED event, got %v", stream.events[0].Type)
+	}
+}
@@ -0,0 +1,118 @@
+package v6
+
+import (
+	"crypto/rand"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/erikh/ldhcpd/db"
+	"github.com/pkg/errors"
+)
+
+// ErrRangeExhausted is returned when no address could be found after
+// repeated random draws, which in practice means the range is nearly full.
+var ErrRangeExhausted = errors.New("IPv6 range exhausted")
+
+// maxAttempts bounds how many random addresses Allocate will try before
+// giving up; with a /64 or larger range collisions should be vanishingly
+// rare, so this mainly protects against a misconfigured, tiny range.
+const maxAttempts = 32
+
+// Allocator allocates IPv6 addresses for stateful DHCPv6, keyed by the
+// client's DUID and the IAID of the requesting identity association.
+// Unlike the v4 Allocator, it has no cursor or bitset: IPv6 pools are
+// effectively unbounded, so addresses are drawn at random within the range
+// and any collision is detected by the database rejecting the insert.
+// Lease and grace-period semantics, and PurgeLeases, are shared with v4 via
+// the same db.DB.
+type Allocator struct {
+	config Config
+	db     *db.DB
+	first  net.IP
+	last   net.IP
+}
+
+// NewAllocator creates a new v6 Allocator.
+func NewAllocator(db *db.DB, c Config) (*Allocator, error) {
+	first, last := c.DynamicRange.Dimensions()
+
+	return &Allocator{
+		config: c,
+		db:     db,
+		first:  first,
+		last:   last,
+	}, nil
+}
+
+// Allocate or retrieve an IPv6 address for the given DUID/IAID pair. renew
+// states that if a lease is already on file, it should be renewed if
+// necessary.
+func (a *Allocator) Allocate(duid []byte, iaid [4]byte, renew bool) (net.IP, error) {
+	now := time.Now()
+
+	l, err := a.db.GetV6Lease(duid, iaid)
+	if err == nil {
+		if renew && (l.LeaseEnd.Before(now) || l.LeaseGraceEnd.Before(now)) {
+			leaseEnd := now.Add(a.config.Lease.Duration)
+			l, err = a.db.RenewV6Lease(duid, iaid, leaseEnd, leaseEnd.Add(a.config.Lease.GracePeriod))
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not renew IPv6 lease for duid [%x] iaid [%x]", duid, iaid)
+			}
+		}
+
+		return l.IP(), nil
+	}
+
+	leaseEnd := now.Add(a.config.Lease.Duration)
+	gracePeriodEnd := leaseEnd.Add(a.config.Lease.GracePeriod)
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		ip, err := randomIPInRange(a.first, a.last)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not generate a random IPv6 address")
+		}
+
+		if err := a.db.SetV6Lease(duid, iaid, ip, leaseEnd, gracePeriodEnd); err != nil {
+			// most likely a collision with an existing lease; try again
+			// with a fresh draw.
+			continue
+		}
+
+		return ip, nil
+	}
+
+	return nil, ErrRangeExhausted
+}
+
+// ListLeases returns every non-expired IPv6 lease on file, for the admin
+// gRPC surface's combined v4/v6 lease view.
+func (a *Allocator) ListLeases() ([]db.V6Lease, error) {
+	leases, err := a.db.V6Leases()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list IPv6 leases")
+	}
+
+	return leases, nil
+}
+
+// randomIPInRange returns a uniformly random address in [from, to].
+func randomIPInRange(from, to net.IP) (net.IP, error) {
+	fromInt := new(big.Int).SetBytes(from.To16())
+	toInt := new(big.Int).SetBytes(to.To16())
+
+	span := new(big.Int).Sub(toInt, fromInt)
+	span.Add(span, big.NewInt(1))
+
+	n, err := rand.Int(rand.Reader, span)
+	if err != nil {
+		return nil, err
+	}
+
+	result := new(big.Int).Add(fromInt, n).Bytes()
+
+	ip := make(net.IP, 16)
+	copy(ip[16-len(result):], result)
+
+	return ip, nil
+}
@@ -0,0 +1,73 @@
+package v6
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/erikh/ldhcpd/db"
+)
+
+func TestAllocatorRandomAssignmentWithinRange(t *testing.T) {
+	config := Config{
+		Lease: Lease{Duration: time.Minute},
+		DynamicRange: Range{
+			From: "2001:db8::1",
+			To:   "2001:db8::ffff",
+		},
+	}
+
+	dbFile := "test-v6.db"
+	defer os.Remove(dbFile)
+
+	d, err := db.NewDB(dbFile)
+	if err != nil {
+		t.Fatalf("error creating database: %v", err)
+	}
+	defer d.Close()
+
+	a, err := NewAllocator(d, config)
+	if err != nil {
+		t.Fatalf("error creating v6 allocator: %v", err)
+	}
+
+	duid1 := []byte{0x00, 0x01, 0xde, 0xad, 0xbe, 0xef}
+	duid2 := []byte{0x00, 0x01, 0xca, 0xfe, 0xba, 0xbe}
+	iaid := [4]byte{0, 0, 0, 1}
+
+	ip1, err := a.Allocate(duid1, iaid, false)
+	if err != nil {
+		t.Fatalf("error allocating first address: %v", err)
+	}
+
+	first, last := config.DynamicRange.Dimensions()
+	if !ipWithinRange(ip1, first, last) {
+		t.Fatalf("allocated address %v fell outside configured range %v -> %v", ip1, first, last)
+	}
+
+	ip2, err := a.Allocate(duid2, iaid, false)
+	if err != nil {
+		t.Fatalf("error allocating second address: %v", err)
+	}
+
+	if ip1.Equal(ip2) {
+		t.Fatal("allocator handed out the same address to two different DUIDs")
+	}
+
+	// asking again for duid1 with the same IAID should return the
+	// existing lease rather than drawing a new address.
+	ip1Again, err := a.Allocate(duid1, iaid, false)
+	if err != nil {
+		t.Fatalf("error re-fetching first lease: %v", err)
+	}
+
+	if !ip1.Equal(ip1Again) {
+		t.Fatalf("expected the same address back for an existing lease, got %v then %v", ip1, ip1Again)
+	}
+}
+
+func ipWithinRange(ip, from, to net.IP) bool {
+	return bytes.Compare(ip.To16(), from.To16()) >= 0 && bytes.Compare(ip.To16(), to.To16()) <= 0
+}
@@ -0,0 +1,103 @@
+// Package v6 provides a stateful DHCPv6 allocator and server, mirroring the
+// v4 semantics in the parent dhcpd package but keyed on DUID/IAID instead of
+// MAC and sized for IPv6's effectively unbounded address space.
+package v6
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultLeaseDuration = 24 * time.Hour
+
+// Range is an IPv6 address range.
+type Range struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+// Dimensions returns the IP addresses within the range.
+func (r Range) Dimensions() (net.IP, net.IP) {
+	return net.ParseIP(r.From).To16(), net.ParseIP(r.To).To16()
+}
+
+func (r Range) validate() error {
+	from, to := r.Dimensions()
+	if from == nil || to == nil {
+		return errors.Errorf("invalid IPv6 in range %v -> %v", r.From, r.To)
+	}
+
+	for i := range from {
+		if from[i] != to[i] {
+			if from[i] > to[i] {
+				return errors.Errorf("IPs are improperly specified in range: %v -> %v", r.From, r.To)
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// Lease holds the lease/grace-period durations for IPv6 leases, mirroring
+// dhcpd.Lease.
+type Lease struct {
+	Duration    time.Duration `yaml:"duration"`
+	GracePeriod time.Duration `yaml:"grace_period"`
+}
+
+// RouterAdvertisement configures optional SLAAC/RA behavior alongside
+// stateful DHCPv6 assignment.
+type RouterAdvertisement struct {
+	Enabled bool   `yaml:"enabled"`
+	Prefix  string `yaml:"prefix"`
+	// ManagedFlag sets the M bit, telling clients to use DHCPv6 for
+	// addresses. OtherFlag sets the O bit, telling clients to use DHCPv6
+	// for other configuration (e.g. DNS) while still self-assigning via
+	// SLAAC.
+	ManagedFlag bool `yaml:"managed_flag"`
+	OtherFlag   bool `yaml:"other_flag"`
+}
+
+// Config is the configuration of the DHCPv6 service.
+type Config struct {
+	DynamicRange        Range                `yaml:"dynamic_range"`
+	DNSServers          []string             `yaml:"dns_servers"`
+	Lease               Lease                `yaml:"lease"`
+	RouterAdvertisement *RouterAdvertisement `yaml:"router_advertisement"`
+}
+
+// Validate checks c for well-formedness and fills in defaults.
+func (c *Config) Validate() error {
+	if err := c.DynamicRange.validate(); err != nil {
+		return errors.Wrap(err, "could not validate IPv6 dynamic range")
+	}
+
+	if len(c.DNSServers) > 0 && len(c.DNS()) == 0 {
+		return errors.New("DNS servers contains invalid IPv6 addresses")
+	}
+
+	if c.Lease.Duration == 0 {
+		c.Lease.Duration = defaultLeaseDuration
+	}
+
+	if c.RouterAdvertisement != nil && c.RouterAdvertisement.Enabled {
+		if net.ParseIP(c.RouterAdvertisement.Prefix) == nil {
+			return errors.New("router advertisement prefix is invalid")
+		}
+	}
+
+	return nil
+}
+
+// DNS returns the IP addresses associated with the DNS servers.
+func (c Config) DNS() []net.IP {
+	ips := []net.IP{}
+	for _, srv := range c.DNSServers {
+		ips = append(ips, net.ParseIP(srv).To16())
+	}
+
+	return ips
+}
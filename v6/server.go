@@ -0,0 +1,109 @@
+package v6
+
+import (
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv6"
+	"github.com/insomniacslk/dhcp/dhcpv6/server6"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Server answers stateful DHCPv6 requests on a single interface, backed by
+// an Allocator.
+type Server struct {
+	config    Config
+	allocator *Allocator
+	inner     *server6.Server
+}
+
+// NewServer creates a DHCPv6 server bound to iface, serving addresses from
+// allocator according to config.
+func NewServer(iface string, config Config, allocator *Allocator) (*Server, error) {
+	s := &Server{config: config, allocator: allocator}
+
+	inner, err := server6.NewServer(iface, nil, s.handle)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not start IPv6 server")
+	}
+	s.inner = inner
+
+	return s, nil
+}
+
+// Serve blocks, handling DHCPv6 requests until the server is closed.
+func (s *Server) Serve() error {
+	return s.inner.Serve()
+}
+
+// Close shuts the server down.
+func (s *Server) Close() error {
+	return s.inner.Close()
+}
+
+func (s *Server) handle(conn net.PacketConn, peer net.Addr, m dhcpv6.DHCPv6) {
+	msg, err := m.GetInnerMessage()
+	if err != nil {
+		logrus.Warnf("v6: could not read inner message from %v: %v", peer, err)
+		return
+	}
+
+	switch msg.Type() {
+	case dhcpv6.MessageTypeSolicit, dhcpv6.MessageTypeRequest, dhcpv6.MessageTypeRenew, dhcpv6.MessageTypeRebind:
+		s.handleRequest(conn, peer, msg)
+	default:
+		logrus.Debugf("v6: ignoring unsupported message type %v from %v", msg.Type(), peer)
+	}
+}
+
+func (s *Server) handleRequest(conn net.PacketConn, peer net.Addr, msg *dhcpv6.Message) {
+	duid := msg.Options.ClientID()
+	if duid == nil {
+		logrus.Warnf("v6: request from %v has no client DUID; ignoring", peer)
+		return
+	}
+
+	iana := msg.Options.OneIANA()
+	if iana == nil {
+		logrus.Warnf("v6: request from %v has no IA_NA; ignoring", peer)
+		return
+	}
+
+	var iaid [4]byte
+	copy(iaid[:], iana.IaId[:])
+
+	renew := msg.Type() == dhcpv6.MessageTypeRenew || msg.Type() == dhcpv6.MessageTypeRebind
+
+	ip, err := s.allocator.Allocate(duid.ToBytes(), iaid, renew)
+	if err != nil {
+		logrus.Warnf("v6: could not allocate an address for %v: %v", duid, err)
+		return
+	}
+
+	resp, err := dhcpv6.NewReplyFromMessage(msg)
+	if err != nil {
+		logrus.Warnf("v6: could not build reply for %v: %v", duid, err)
+		return
+	}
+
+	resp.AddOption(&dhcpv6.OptIANA{
+		IaId: iana.IaId,
+		Options: dhcpv6.IdentityOptions{
+			Options: []dhcpv6.Option{
+				&dhcpv6.OptIAAddress{
+					IPv6Addr:          ip,
+					PreferredLifetime: s.config.Lease.Duration,
+					ValidLifetime:     s.config.Lease.Duration + s.config.Lease.GracePeriod,
+				},
+			},
+		},
+	})
+
+	if dns := s.config.DNS(); len(dns) > 0 {
+		resp.AddOption(dhcpv6.OptDNS(dns...))
+	}
+
+	if _, err := conn.WriteTo(resp.ToBytes(), peer); err != nil {
+		logrus.Warnf("v6: could not send reply to %v: %v", peer, err)
+	}
+}